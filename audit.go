@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// AuditEntry is a line of the audit log, an action taken through the bot
+type AuditEntry struct {
+	Time     time.Time       `json:"time"`
+	UserID   int             `json:"user_id"`
+	User     string          `json:"user"`
+	ChatID   int64           `json:"chat_id"`
+	Backend  string          `json:"backend"`
+	Command  string          `json:"command"`
+	Torrents []*AuditTorrent `json:"torrents,omitempty"`
+	Result   string          `json:"result"`
+}
+
+// AuditTorrent is a torrent an audited action was taken on
+type AuditTorrent struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+}
+
+// buttonAudit is what gets audited once a button is pressed
+type buttonAudit struct {
+	view     *View
+	command  string
+	torrents deluge.Torrents
+}
+
+// auditRecorder keeps the replies of a single audited command, along with the ones of the
+// follow-ups it leaves running, e.g. a move being watched until it's done.
+type auditRecorder struct {
+	mu        sync.Mutex
+	replies   []string
+	torrents  []*AuditTorrent // the ones it added, which have no selector
+	followUps sync.WaitGroup
+}
+
+var (
+	// the audit log, -datadir's audit.jsonl if it's empty, no audit log if neither is set
+	AuditLog string
+	auditMu  sync.Mutex
+
+	// the recorders of the audited commands that are running, by the message that ran them
+	auditRecorders   = make(map[*tgbotapi.Message]*auditRecorder)
+	auditRecordersMu sync.Mutex
+
+	// the entries that wait for follow-ups to be written, a shutdown waits for them
+	pendingAudits sync.WaitGroup
+
+	// the audits of the buttons by their callback data, pruned along with the buttons
+	buttonAudits = make(map[string]*buttonAudit)
+
+	// the longest result that gets logged, the rest is cut
+	maxAuditResult = 1000
+)
+
+// the Audit of the commands, by where their selectors are
+func noSelectors(args []string) []string    { return nil }
+func allSelectors(args []string) []string   { return args }
+func firstSelector(args []string) []string  { return nthSelector(args, 0) }
+func secondSelector(args []string) []string { return nthSelector(args, 1) }
+
+func nthSelector(args []string, n int) []string {
+	if len(args) <= n {
+		return nil
+	}
+	return args[n : n+1]
+}
+
+// auditFile returns the audit log's file, or "" if there's none
+func auditFile() string {
+	if AuditLog != "" {
+		return AuditLog
+	}
+	if DataDir == "" {
+		return ""
+	}
+	return filepath.Join(DataDir, "audit.jsonl")
+}
+
+// writeAudit appends an entry to the audit log
+func writeAudit(entry *AuditEntry) {
+	file := auditFile()
+	if file == "" {
+		return
+	}
+
+	if len(entry.Result) > maxAuditResult {
+		// cut at the start of a character
+		cut := maxAuditResult
+		for cut > 0 && !utf8.RuneStart(entry.Result[cut]) {
+			cut--
+		}
+		entry.Result = entry.Result[:cut] + "…"
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("[ERROR] Audit: %s", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("[ERROR] Audit: %s", err)
+		return
+	}
+	defer f.Close()
+
+	// a single write per line, so lines never interleave
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("[ERROR] Audit: %s", err)
+	}
+}
+
+// recorderOf returns the recorder of the command that ud ran, or nil if it isn't audited
+func recorderOf(ud tgbotapi.Update) *auditRecorder {
+	auditRecordersMu.Lock()
+	defer auditRecordersMu.Unlock()
+	return auditRecorders[ud.Message]
+}
+
+// send sends a reply and records it, a nil recorder only sends it
+func (r *auditRecorder) send(text string, chatID int64, markdown bool) int {
+	r.record(text)
+	return send(text, chatID, markdown)
+}
+
+// record keeps a reply, e.g. the text a message got edited to
+func (r *auditRecorder) record(text string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.replies = append(r.replies, text)
+	r.mu.Unlock()
+}
+
+// added keeps a torrent that the command added
+func (r *auditRecorder) added(hash, name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.torrents = append(r.torrents, &AuditTorrent{Hash: hash, Name: name})
+	r.mu.Unlock()
+}
+
+// followUp holds the entry until done gets called, for what keeps replying after the command returns
+func (r *auditRecorder) followUp() {
+	if r != nil {
+		r.followUps.Add(1)
+	}
+}
+
+// done tells the recorder that a follow-up is done
+func (r *auditRecorder) done() {
+	if r != nil {
+		r.followUps.Done()
+	}
+}
+
+// auditTorrents resolves the command's selectors the way the command itself does, "all" is
+// listed without updating the view.
+func auditTorrents(view *View, cmd *Command, args []string) []*AuditTorrent {
+	selects := cmd.Selects
+	if selects == nil {
+		selects = (*View).Select
+	}
+
+	var torrents deluge.Torrents
+	for _, selector := range cmd.Audit(args) {
+		if selector == "all" {
+			all, err := view.Client.GetTorrents("name")
+			if err != nil {
+				log.Printf("[ERROR] Deluge: %s", err)
+				continue
+			}
+			torrents = append(torrents, all...)
+			continue
+		}
+
+		// the command reports it as well, the entry is left without those torrents
+		selected, err := selects(view, selector)
+		if err != nil {
+			log.Printf("[INFO] Audit: %s: %s", cmd.Name, err)
+			continue
+		}
+		torrents = append(torrents, selected...)
+	}
+	return auditList(torrents)
+}
+
+// auditList lists the torrents for an entry
+func auditList(torrents deluge.Torrents) []*AuditTorrent {
+	list := make([]*AuditTorrent, len(torrents))
+	for i, t := range torrents {
+		list[i] = &AuditTorrent{Hash: t.Hash, Name: t.Name}
+	}
+	return list
+}
+
+// audited runs a command, and logs it to the audit log with the torrents it selects and the
+// replies it sends through its recorder as its result if it changes anything; the dispatcher
+// runs the commands through it.
+func audited(view *View, ud tgbotapi.Update, cmd *Command, args []string) {
+	if cmd.Audit == nil || cmd.roleFor(args) != RoleMaster || auditFile() == "" {
+		cmd.Run(view, ud, args)
+		return
+	}
+
+	entry := &AuditEntry{
+		Time:     time.Now(),
+		UserID:   ud.Message.From.ID,
+		User:     ud.Message.From.String(),
+		ChatID:   ud.Message.Chat.ID,
+		Backend:  view.Name,
+		Command:  ud.Message.Text,
+		Torrents: auditTorrents(view, cmd, args),
+	}
+
+	r := new(auditRecorder)
+	auditRecordersMu.Lock()
+	auditRecorders[ud.Message] = r
+	auditRecordersMu.Unlock()
+
+	cmd.Run(view, ud, args)
+
+	// the entry gets written once the follow-ups are done as well
+	write := func() {
+		r.followUps.Wait()
+
+		auditRecordersMu.Lock()
+		delete(auditRecorders, ud.Message)
+		auditRecordersMu.Unlock()
+
+		entry.Torrents = append(entry.Torrents, r.torrents...)
+		entry.Result = strings.TrimSpace(strings.Join(r.replies, "\n"))
+		writeAudit(entry)
+	}
+	if !hold(&pendingAudits) {
+		write() // the follow-ups are stopping as well
+		return
+	}
+	go func() {
+		defer pendingAudits.Done()
+		write()
+	}()
+}
+
+// newAuditedButton returns an inline button that runs action once it's pressed, and logs the
+// press to the audit log as command with the answer as its result.
+func newAuditedButton(text string, view *View, command string, torrents deluge.Torrents, action buttonAction) tgbotapi.InlineKeyboardButton {
+	button := newButton(text, action)
+
+	buttonsMu.Lock()
+	buttonAudits[*button.CallbackData] = &buttonAudit{view, command, torrents}
+	buttonsMu.Unlock()
+
+	return button
+}
+
+// auditButton logs a press of an audited button along with its answer
+func auditButton(cq *tgbotapi.CallbackQuery, audit *buttonAudit, answer string) {
+	entry := &AuditEntry{
+		Time:     time.Now(),
+		UserID:   cq.From.ID,
+		User:     cq.From.String(),
+		Backend:  audit.view.Name,
+		Command:  audit.command,
+		Torrents: auditList(audit.torrents),
+		Result:   answer,
+	}
+	if cq.Message != nil {
+		entry.ChatID = cq.Message.Chat.ID
+	}
+	writeAudit(entry)
+}
+
+// readAudit returns the last n entries of the audit log, only the user's if it isn't empty
+func readAudit(n int, user string) ([]*AuditEntry, error) {
+	f, err := os.Open(auditFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	user = strings.ToLower(strings.TrimPrefix(user, "@"))
+
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		entry := new(AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue // a line cut short by a crash
+		}
+		if user != "" && strings.ToLower(entry.User) != user && strconv.Itoa(entry.UserID) != user {
+			continue
+		}
+
+		entries = append(entries, entry)
+		if len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// history lists the last actions taken through the bot, 10 or n of them, optionally only a user's
+func history(ud tgbotapi.Update, tokens []string) {
+	if auditFile() == "" {
+		send("history: there's no audit log, set -auditlog or -datadir", ud.Message.Chat.ID, false)
+		return
+	}
+
+	n := 10
+	var user string
+	for _, token := range tokens {
+		if num, err := strconv.Atoi(token); err == nil && num > 0 {
+			n = num
+		} else {
+			user = token
+		}
+	}
+
+	entries, err := readAudit(n, user)
+	if err != nil {
+		log.Printf("[ERROR] Audit: %s", err)
+		send("history: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+	if len(entries) == 0 {
+		send("history: No actions", ud.Message.Chat.ID, false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	for _, e := range entries {
+		buf.WriteString(fmt.Sprintf("%s %s [%s]: %s\n", e.Time.Format("2006-01-02 15:04"), e.User, e.Backend, e.Command))
+		for i, t := range e.Torrents {
+			if i == 5 {
+				buf.WriteString(fmt.Sprintf("  and %d more torrents\n", len(e.Torrents)-i))
+				break
+			}
+			buf.WriteString(fmt.Sprintf("  %s\n", t.Name))
+		}
+		if result := strings.SplitN(e.Result, "\n", 2)[0]; result != "" {
+			buf.WriteString(fmt.Sprintf("  → %s\n", result))
+		}
+	}
+	send(buf.String(), ud.Message.Chat.ID, false)
+}
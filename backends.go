@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Backend is a named Deluge instance as configured in the -config file.
+type Backend struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Password string `json:"password"`
+	Daemon   string `json:"daemon"`
+}
+
+var (
+	// a view for every backend, the first one is the default
+	views []*View
+
+	// the view each chat is using, chats that never called "use" get the default
+	chatViews   = make(map[int64]*View)
+	chatViewsMu sync.Mutex
+)
+
+// loadBackends reads the backends out of a config file in the form of:
+// {"backends": [{"name": "home", "url": "http://localhost:8112", "password": "...", "daemon": "127.0.0.1:58846"}]}
+func loadBackends(file string) ([]*Backend, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &struct {
+		Backends []*Backend `json:"backends"`
+	}{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	if len(config.Backends) == 0 {
+		return nil, fmt.Errorf("%s has no backends", file)
+	}
+
+	seen := make(map[string]bool)
+	for _, b := range config.Backends {
+		b.Name = strings.ToLower(b.Name)
+		switch {
+		case b.Name == "" || strings.ContainsAny(b.Name, " @"):
+			return nil, fmt.Errorf("backend names can't be empty or have spaces or '@' in them")
+		case b.Name == "all":
+			return nil, fmt.Errorf("'all' can't be a backend name")
+		case seen[b.Name]:
+			return nil, fmt.Errorf("more than one backend is named %s", b.Name)
+		case b.URL == "":
+			return nil, fmt.Errorf("backend %s has no url", b.Name)
+		}
+		seen[b.Name] = true
+	}
+
+	return config.Backends, nil
+}
+
+// Label returns the view's name to prefix messages that aren't replies with,
+// or nothing if it's the only backend.
+func (v *View) Label() string {
+	if len(views) < 2 {
+		return ""
+	}
+	return "[" + v.Name + "] "
+}
+
+// viewByName returns the view of the backend with the given name, or nil if there's none
+func viewByName(name string) *View {
+	for _, v := range views {
+		if strings.EqualFold(v.Name, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// chatView returns the view that the chat is using
+func chatView(chatID int64) *View {
+	chatViewsMu.Lock()
+	defer chatViewsMu.Unlock()
+
+	if v, ok := chatViews[chatID]; ok {
+		return v
+	}
+	return views[0]
+}
+
+// use takes a backend's name to switch the chat to it, or lists the backends without an argument
+func use(ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		current := chatView(ud.Message.Chat.ID)
+
+		buf := new(bytes.Buffer)
+		for _, v := range views {
+			if v == current {
+				buf.WriteString(fmt.Sprintf("*%s* (in use)\n", v.Name))
+				continue
+			}
+			buf.WriteString(v.Name + "\n")
+		}
+		send(buf.String(), ud.Message.Chat.ID, true)
+		return
+	}
+
+	v := viewByName(tokens[0])
+	if v == nil {
+		send(fmt.Sprintf("use: no such backend %s", tokens[0]), ud.Message.Chat.ID, false)
+		return
+	}
+
+	chatViewsMu.Lock()
+	chatViews[ud.Message.Chat.ID] = v
+	chatViewsMu.Unlock()
+
+	send("use: switched to "+v.Name, ud.Message.Chat.ID, false)
+}
+
+// speedAll returns the download and upload speeds of every backend along with their totals,
+// the backends are queried concurrently.
+func speedAll() string {
+	type rate struct {
+		download, upload float64
+		err              error
+	}
+
+	rates := make([]rate, len(views))
+	var wg sync.WaitGroup
+	for i, v := range views {
+		wg.Add(1)
+		go func(i int, v *View) {
+			defer wg.Done()
+			rates[i].download, rates[i].upload, rates[i].err = v.Client.SpeedRate()
+		}(i, v)
+	}
+	wg.Wait()
+
+	var (
+		buf              = new(bytes.Buffer)
+		download, upload float64
+	)
+	for i, v := range views {
+		if rates[i].err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, rates[i].err)
+			buf.WriteString(fmt.Sprintf("%s: ↓ *-*  ↑ *-*\n", v.Name))
+			continue
+		}
+
+		download += rates[i].download
+		upload += rates[i].upload
+		buf.WriteString(fmt.Sprintf("%s: ↓ *%s*  ↑ *%s*\n", v.Name,
+			humanize.Bytes(uint64(rates[i].download)), humanize.Bytes(uint64(rates[i].upload))))
+	}
+	buf.WriteString(fmt.Sprintf("\nTotal: ↓ *%s*  ↑ *%s*", humanize.Bytes(uint64(download)), humanize.Bytes(uint64(upload))))
+
+	return buf.String()
+}
+
+// countAll returns the torrents counts per status of every backend along with their totals,
+// the backends are queried concurrently.
+func countAll() string {
+	type tree struct {
+		states [][]interface{}
+		err    error
+	}
+
+	trees := make([]tree, len(views))
+	var wg sync.WaitGroup
+	for i, v := range views {
+		wg.Add(1)
+		go func(i int, v *View) {
+			defer wg.Done()
+			trees[i].states, _, trees[i].err = v.Client.FilterTree()
+		}(i, v)
+	}
+	wg.Wait()
+
+	var (
+		buf    = new(bytes.Buffer)
+		totals = make(map[string]float64)
+		order  []string
+	)
+	for i, v := range views {
+		buf.WriteString(fmt.Sprintf("*%s*\n", v.Name))
+		if trees[i].err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, trees[i].err)
+			buf.WriteString("unreachable\n\n")
+			continue
+		}
+
+		for _, s := range trees[i].states {
+			state := fmt.Sprintf("%v", s[0])
+			n, _ := s[1].(float64)
+			if _, ok := totals[state]; !ok {
+				order = append(order, state)
+			}
+			totals[state] += n
+			buf.WriteString(fmt.Sprintf("%s: %v\n", state, s[1]))
+		}
+		buf.WriteString("\n")
+	}
+
+	buf.WriteString("*Total*\n")
+	for _, state := range order {
+		buf.WriteString(fmt.Sprintf("%s: %v\n", state, totals[state]))
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// bdecoder decodes bencoded data, the encoding of .torrent files, into strings,
+// int64s, []interface{}s and map[string]interface{}s.
+type bdecoder struct {
+	data  []byte
+	pos   int
+	depth int // of the value being decoded
+}
+
+// how deep lists and dictionaries may nest, .torrent files need a few levels, and the
+// stack would run out with a crafted file that nests all the way
+var maxBencodeDepth = 32
+
+// bdecode decodes a single bencoded value that takes all of data
+func bdecode(data []byte) (interface{}, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("bencode: trailing data at %d", d.pos)
+	}
+	return v, nil
+}
+
+// bdecodeRaw decodes a bencoded dictionary into the raw bytes of each of its values,
+// e.g. to hash the "info" of a .torrent file exactly the way it was encoded.
+func bdecodeRaw(data []byte) (map[string][]byte, error) {
+	d := &bdecoder{data: data}
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("bencode: not a dictionary")
+	}
+	d.pos++
+
+	raw := make(map[string][]byte)
+	for {
+		if d.pos >= len(d.data) {
+			return nil, fmt.Errorf("bencode: unexpected end of data")
+		}
+		if d.data[d.pos] == 'e' {
+			d.pos++
+			return raw, nil
+		}
+
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		start := d.pos
+		if _, err := d.value(); err != nil {
+			return nil, err
+		}
+		raw[key] = d.data[start:d.pos]
+	}
+}
+
+func (d *bdecoder) value() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("bencode: unexpected end of data")
+	}
+
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxBencodeDepth {
+		return nil, fmt.Errorf("bencode: nested deeper than %d at %d", maxBencodeDepth, d.pos)
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		return d.integer()
+	case c == 'l':
+		d.pos++
+		list := []interface{}{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, fmt.Errorf("bencode: unexpected end of data")
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+		for {
+			if d.pos >= len(d.data) {
+				return nil, fmt.Errorf("bencode: unexpected end of data")
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+		}
+	case c >= '0' && c <= '9':
+		return d.string()
+	default:
+		return nil, fmt.Errorf("bencode: unexpected %q at %d", c, d.pos)
+	}
+}
+
+// integer decodes i<number>e
+func (d *bdecoder) integer() (int64, error) {
+	end := d.pos + 1
+	for end < len(d.data) && d.data[end] != 'e' {
+		end++
+	}
+	if end >= len(d.data) {
+		return 0, fmt.Errorf("bencode: unexpected end of data")
+	}
+
+	n, err := strconv.ParseInt(string(d.data[d.pos+1:end]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bencode: bad integer at %d", d.pos)
+	}
+	d.pos = end + 1
+	return n, nil
+}
+
+// string decodes <length>:<bytes>
+func (d *bdecoder) string() (string, error) {
+	colon := d.pos
+	for colon < len(d.data) && d.data[colon] != ':' {
+		colon++
+	}
+	if colon >= len(d.data) {
+		return "", fmt.Errorf("bencode: unexpected end of data")
+	}
+
+	n, err := strconv.Atoi(string(d.data[d.pos:colon]))
+	// n is checked before it's added to, a huge one would overflow
+	if err != nil || n < 0 || n > len(d.data)-colon-1 {
+		return "", fmt.Errorf("bencode: bad string at %d", d.pos)
+	}
+	s := string(d.data[colon+1 : colon+1+n])
+	d.pos = colon + 1 + n
+	return s, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBdecode(t *testing.T) {
+	tests := []struct {
+		data string
+		want interface{}
+		err  bool
+	}{
+		{data: "i42e", want: int64(42)},
+		{data: "i-7e", want: int64(-7)},
+		{data: "4:spam", want: "spam"},
+		{data: "0:", want: ""},
+		{data: "le", want: []interface{}{}},
+		{data: "l4:spami3ee", want: []interface{}{"spam", int64(3)}},
+		{data: "d3:cow3:moo4:spaml1:a1:bee", want: map[string]interface{}{"cow": "moo", "spam": []interface{}{"a", "b"}}},
+
+		{data: "", err: true},
+		{data: "i42", err: true},
+		{data: "iabce", err: true},
+		{data: "5:spam", err: true},
+		{data: "-1:a", err: true},
+		{data: "9223372036854775807:a", err: true}, // would overflow once the length is added to
+		{data: "l4:spam", err: true},
+		{data: "d3:cowe", err: true},
+		{data: "di1e3:mooe", err: true},
+		{data: "4:spamextra", err: true},
+		{data: "x", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := bdecode([]byte(test.data))
+		if test.err {
+			if err == nil {
+				t.Errorf("bdecode(%q) = %v, want an error", test.data, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("bdecode(%q): %s", test.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("bdecode(%q) = %#v, want %#v", test.data, got, test.want)
+		}
+	}
+}
+
+func TestBdecodeDepth(t *testing.T) {
+	nested := func(n int) []byte {
+		return []byte(strings.Repeat("l", n) + strings.Repeat("e", n))
+	}
+
+	if _, err := bdecode(nested(maxBencodeDepth)); err != nil {
+		t.Errorf("%d nested lists: %s", maxBencodeDepth, err)
+	}
+	if _, err := bdecode(nested(maxBencodeDepth + 1)); err == nil {
+		t.Errorf("%d nested lists decoded, want an error", maxBencodeDepth+1)
+	}
+
+	// about what a crafted 10 MB .torrent can nest
+	if _, err := bdecode(nested(5 << 20)); err == nil {
+		t.Errorf("%d nested lists decoded, want an error", 5<<20)
+	}
+	if _, err := parseMetainfo([]byte("d4:info" + string(nested(1<<20)) + "e")); err == nil {
+		t.Errorf("an info of %d nested lists parsed, want an error", 1<<20)
+	}
+}
+
+func TestParseMetainfo(t *testing.T) {
+	// the keys of the info aren't sorted, so the hash only matches the info as it was encoded
+	single := "d6:lengthi5e4:name5:a.txt12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei1ee"
+	multi := "d4:name3:dir12:piece lengthi32768e6:pieces20:bbbbbbbbbbbbbbbbbbbb" +
+		"5:filesld6:lengthi3e4:pathl3:sub5:x.binee" + "d6:lengthi4e4:pathl5:y.txteeee"
+
+	tests := []struct {
+		name     string
+		data     string
+		info     string
+		want     *Metainfo
+		trackers []string
+	}{
+		{
+			name: "single file",
+			data: "d8:announce20:http://t.example/ann4:info" + single + "e",
+			info: single,
+			want: &Metainfo{Name: "a.txt", Size: 5, PieceLength: 16384, Private: true,
+				Files: []*MetaFile{{Path: "a.txt", Size: 5}}},
+			trackers: []string{"http://t.example/ann"},
+		},
+		{
+			name: "multi file",
+			data: "d8:announce20:http://t.example/ann13:announce-listll13:udp://a.ex:8013:udp://b.ex:80el13:udp://a.ex:80ee4:info" + multi + "e",
+			info: multi,
+			want: &Metainfo{Name: "dir", Size: 7, PieceLength: 32768,
+				Files: []*MetaFile{{Path: "dir/sub/x.bin", Size: 3}, {Path: "dir/y.txt", Size: 4}}},
+			trackers: []string{"udp://a.ex:80", "udp://b.ex:80"},
+		},
+	}
+
+	for _, test := range tests {
+		mi, err := parseMetainfo([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		sum := sha1.Sum([]byte(test.info))
+		if want := hex.EncodeToString(sum[:]); mi.Hash != want {
+			t.Errorf("%s: hash %s, want %s", test.name, mi.Hash, want)
+		}
+		if !reflect.DeepEqual(mi.Trackers, test.trackers) {
+			t.Errorf("%s: trackers %q, want %q", test.name, mi.Trackers, test.trackers)
+		}
+
+		mi.Hash, mi.Trackers = "", nil
+		if !reflect.DeepEqual(mi, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, mi, test.want)
+		}
+	}
+
+	for _, data := range []string{"", "le", "d8:announce1:xe", "d4:infoi1ee"} {
+		if _, err := parseMetainfo([]byte(data)); err == nil {
+			t.Errorf("parseMetainfo(%q) parsed, want an error", data)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// buttonAction is what an inline button does once it's pressed, it returns the text
+// to answer the press with.
+type buttonAction func(cq *tgbotapi.CallbackQuery) string
+
+var (
+	// the actions of the inline buttons by their callback data, the data is only a
+	// number since telegram limits it to 64 bytes
+	buttonActions = make(map[string]buttonAction)
+	buttonOrder   []string
+	buttonsMu     sync.Mutex
+	buttonSeq     uint64
+
+	// how many buttons are kept, the oldest ones stop working past it
+	maxButtons = 1000
+)
+
+// newButton returns an inline button that runs action once it's pressed
+func newButton(text string, action buttonAction) tgbotapi.InlineKeyboardButton {
+	data := strconv.FormatUint(atomic.AddUint64(&buttonSeq, 1), 10)
+
+	buttonsMu.Lock()
+	buttonActions[data] = action
+	buttonOrder = append(buttonOrder, data)
+	if len(buttonOrder) > maxButtons {
+		delete(buttonActions, buttonOrder[0])
+		delete(buttonAudits, buttonOrder[0])
+		buttonOrder = buttonOrder[1:]
+	}
+	buttonsMu.Unlock()
+
+	return tgbotapi.NewInlineKeyboardButtonData(text, data)
+}
+
+// pressButton runs the action of the pressed button and answers the press
+func pressButton(cq *tgbotapi.CallbackQuery) {
+	buttonsMu.Lock()
+	action, ok := buttonActions[cq.Data]
+	audit := buttonAudits[cq.Data]
+	buttonsMu.Unlock()
+
+	answer := "This button has expired"
+	if ok {
+		answer = action(cq)
+	}
+	if ok && audit != nil && auditFile() != "" {
+		auditButton(cq, audit, answer)
+	}
+
+	if _, err := Bot.AnswerCallbackQuery(tgbotapi.NewCallback(cq.ID, answer)); err != nil {
+		log.Printf("[ERROR] Telegram: %s", err)
+	}
+}
+
+// sendButtons sends text along with rows of inline buttons, returns the message id of the sent message
+func sendButtons(text string, chatID int64, markdown bool, rows ...[]tgbotapi.InlineKeyboardButton) int {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.DisableWebPagePreview = true
+	if markdown {
+		msg.ParseMode = tgbotapi.ModeMarkdown
+	}
+	if len(rows) > 0 {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
+
+	resp, err := Bot.Send(msg)
+	if err != nil {
+		sendFailed(err)
+	}
+
+	return resp.MessageID
+}
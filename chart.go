@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// chartSeries is a line of a chart panel
+type chartSeries struct {
+	Label  string
+	Color  color.RGBA
+	Values []float64 // one for each of the chart's times
+}
+
+// chartPanel is a plot of one or more series that share a Y axis
+type chartPanel struct {
+	Series []chartSeries
+	Max    float64 // the top of the Y axis, or 0 to fit the values
+	Format func(float64) string
+}
+
+var (
+	chartWidth       = 800
+	chartPanelHeight = 280
+
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartGrid       = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	chartText       = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	chartDownload   = color.RGBA{0x1f, 0x77, 0xb4, 0xff}
+	chartUpload     = color.RGBA{0x2c, 0xa0, 0x2c, 0xff}
+	chartProgress   = color.RGBA{0xff, 0x7f, 0x0e, 0xff}
+)
+
+const (
+	chartMarginLeft   = 80
+	chartMarginRight  = 20
+	chartMarginTop    = 30
+	chartMarginBottom = 25
+)
+
+// renderChart draws the panels stacked under a title as a PNG, spanning from one time to
+// another. times are the X values of every series, and a gap longer than twice gap between
+// two of them breaks the lines.
+func renderChart(title string, from, to time.Time, times []time.Time, gap time.Duration, panels ...chartPanel) ([]byte, error) {
+	if len(times) < 2 {
+		return nil, fmt.Errorf("not enough samples yet")
+	}
+
+	height := len(panels) * chartPanelHeight
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.Point{}, draw.Src)
+
+	drawText(img, chartMarginLeft, 18, title, chartText)
+
+	for i, panel := range panels {
+		plot := image.Rect(chartMarginLeft, i*chartPanelHeight+chartMarginTop,
+			chartWidth-chartMarginRight, (i+1)*chartPanelHeight-chartMarginBottom)
+		drawPanel(img, plot, panel, times, from, to, gap)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawPanel draws the panel's grid, axes labels, legend and lines within plot
+func drawPanel(img *image.RGBA, plot image.Rectangle, panel chartPanel, times []time.Time, from, to time.Time, gap time.Duration) {
+	top := panel.Max
+	if top == 0 {
+		for _, s := range panel.Series {
+			for _, v := range s.Values {
+				top = math.Max(top, v)
+			}
+		}
+		top = niceCeil(top)
+	}
+
+	// Y grid and labels
+	const yTicks = 4
+	for i := 0; i <= yTicks; i++ {
+		y := plot.Max.Y - i*plot.Dy()/yTicks
+		drawLine(img, plot.Min.X, y, plot.Max.X, y, chartGrid)
+		label := panel.Format(top * float64(i) / yTicks)
+		drawText(img, plot.Min.X-8-textWidth(label), y+4, label, chartText)
+	}
+
+	// X grid and labels, with dates once the chart is longer than a day
+	layout := "15:04"
+	if to.Sub(from) > 24*time.Hour {
+		layout = "Jan 2 15:04"
+	}
+	const xTicks = 6
+	for i := 0; i <= xTicks; i++ {
+		x := plot.Min.X + i*plot.Dx()/xTicks
+		drawLine(img, x, plot.Min.Y, x, plot.Max.Y, chartGrid)
+		label := from.Add(to.Sub(from) * time.Duration(i) / xTicks).Format(layout)
+		drawText(img, x-textWidth(label)/2, plot.Max.Y+16, label, chartText)
+	}
+
+	// the legend goes above the plot's top right corner
+	x := plot.Max.X
+	for i := len(panel.Series) - 1; i >= 0; i-- {
+		s := panel.Series[i]
+		x -= textWidth(s.Label)
+		drawText(img, x, plot.Min.Y-6, s.Label, chartText)
+		x -= 16
+		draw.Draw(img, image.Rect(x, plot.Min.Y-14, x+10, plot.Min.Y-4), &image.Uniform{s.Color}, image.Point{}, draw.Src)
+		x -= 12
+	}
+
+	span := to.Sub(from).Seconds()
+	point := func(i int, v float64) (int, int) {
+		px := plot.Min.X + int(float64(plot.Dx())*times[i].Sub(from).Seconds()/span)
+		py := plot.Max.Y - int(float64(plot.Dy())*math.Min(v, top)/top)
+		return px, py
+	}
+	for _, s := range panel.Series {
+		for i := 1; i < len(s.Values) && i < len(times); i++ {
+			if times[i].Sub(times[i-1]) > 2*gap {
+				continue
+			}
+			x0, y0 := point(i-1, s.Values[i-1])
+			x1, y1 := point(i, s.Values[i])
+			drawLine(img, x0, y0, x1, y1, s.Color)
+			drawLine(img, x0, y0-1, x1, y1-1, s.Color)
+		}
+	}
+}
+
+// niceCeil rounds v up to 1, 2 or 5 times a power of ten, so the Y labels are round
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	exp := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*exp {
+			return m * exp
+		}
+	}
+	return 10 * exp
+}
+
+// drawLine draws a line from x0,y0 to x1,y1 with Bresenham's algorithm
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	e := dx + dy
+	for {
+		img.SetRGBA(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// drawText draws text with its baseline starting at x,y
+func drawText(img *image.RGBA, x, y int, text string, c color.RGBA) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  &image.Uniform{c},
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+}
+
+// textWidth returns how wide text gets drawn in pixels
+func textWidth(text string) int {
+	return font.MeasureString(basicfont.Face7x13, text).Round()
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Role is what a user is allowed to do through the bot
+type Role int
+
+const (
+	// RoleViewer lists and shows things, it's for -viewers and the master
+	RoleViewer Role = iota
+	// RoleMaster changes things, it's only for the master
+	RoleMaster
+)
+
+// anyArgs is the MaxArgs of the commands that take any number of arguments
+const anyArgs = -1
+
+// Command is a command of the bot, the dispatcher, help, Telegram's command
+// menu, authorization, audit logging and argument checks all go by it.
+type Command struct {
+	Name    string
+	Aliases []string // short names, e.g. "li" for "list"
+	Args    string   // what the arguments are, for the argument checks
+	MinArgs int
+	MaxArgs int // anyArgs for no limit
+	Role    Role
+	Offline bool // works while the backend is unreachable
+	Help    string
+
+	// MasterArgs is for the commands that change something only with some arguments, e.g. "queue set",
+	// it reports whether the arguments do so the call takes RoleMaster.
+	MasterArgs func(args []string) bool
+
+	// Audit tells which of the arguments are selectors, the calls that take RoleMaster go to the
+	// audit log along with the torrents they select; nil for commands that never change anything.
+	Audit func(args []string) (selectors []string)
+
+	// Selects is how the command resolves its selectors, for the audit log; nil for view.Select.
+	Selects func(view *View, selector string) (deluge.Torrents, error)
+
+	Run func(view *View, ud tgbotapi.Update, args []string)
+}
+
+var (
+	// the commands in the order help lists them, and by their names and aliases
+	commands     []*Command
+	commandNames = make(map[string]*Command)
+
+	// the users who may run the RoleViewer commands besides the master
+	Viewers []string
+)
+
+const helpNotes = `
+	- Selectors are an ID, a range of IDs like _3-7_, a comma separated list of those, or _all_.
+	- Prefix a command with _@name_ to run it once against another backend, e.g. "*@seedbox2 list*".
+	- Prefix commands with '/' if you want to talk to your bot in a group.
+	- report any issues [here](https://github.com/pyed/deluge-telegram)
+	`
+
+// commands that take a view and nothing else
+func noArgs(f func(*View, tgbotapi.Update)) func(*View, tgbotapi.Update, []string) {
+	return func(view *View, ud tgbotapi.Update, args []string) { f(view, ud) }
+}
+
+// commands that take no view
+func noView(f func(tgbotapi.Update, []string)) func(*View, tgbotapi.Update, []string) {
+	return func(view *View, ud tgbotapi.Update, args []string) { f(ud, args) }
+}
+
+// the MasterArgs of the commands that change something once they get more than n arguments
+func moreArgsThan(n int) func([]string) bool {
+	return func(args []string) bool { return len(args) > n }
+}
+
+// queueCommand moves torrents within the queue in a direction
+func queueCommand(direction string) func(*View, tgbotapi.Update, []string) {
+	return func(view *View, ud tgbotapi.Update, args []string) { queueMove(view, ud, direction, args) }
+}
+
+func init() {
+	commands = []*Command{
+		{Name: "list", Aliases: []string{"li"}, Args: "[tracker query]", MaxArgs: 1, Run: list,
+			Help: "Lists all the torrents, takes an optional argument which is a query to list only torrents that has a tracker matches the query, or some of it."},
+		{Name: "head", Aliases: []string{"he"}, Args: "[n]", MaxArgs: 1, Run: head,
+			Help: "Lists the first n number of torrents, n defaults to 5 if no argument is provided."},
+		{Name: "tail", Aliases: []string{"ta"}, Args: "[n]", MaxArgs: 1, Run: tail,
+			Help: "Lists the last n number of torrents, n defaults to 5 if no argument is provided."},
+		{Name: "downs", Aliases: []string{"dl", "down"}, Run: noArgs(downs),
+			Help: "Lists torrents with the status of Downloading or in the queue to download."},
+		{Name: "seeding", Aliases: []string{"sd"}, Run: noArgs(seeding),
+			Help: "Lists torrents with the status of Seeding or in the queue to seed."},
+		{Name: "paused", Aliases: []string{"pa"}, Run: noArgs(paused),
+			Help: "Lists Paused torrents."},
+		{Name: "checking", Aliases: []string{"ch"}, Run: noArgs(checking),
+			Help: "Lists torrents with the status of Verifying or in the queue to verify."},
+		{Name: "active", Aliases: []string{"ac"}, Run: noArgs(active),
+			Help: "Lists torrents that are actively uploading or downloading."},
+		{Name: "errors", Aliases: []string{"er"}, Run: noArgs(errors),
+			Help: "Lists torrents in the Error state with their message, the ones with missing files, and failing trackers grouped by tracker and message, with buttons to resume, recheck or reannounce them."},
+		{Name: "stalled", Run: noArgs(stalled),
+			Help: "Lists downloading torrents that made no progress for a while, have no seeds or no download rate, with how long each has been stuck."},
+		{Name: "update", Aliases: []string{"ud"},
+			Run:  func(view *View, ud tgbotapi.Update, args []string) { view.Update() },
+			Help: "Refreshes the torrents, so the IDs match what Deluge has now without listing anything."},
+		{Name: "sort", Aliases: []string{"so"}, Args: "[field] [reversed]", MaxArgs: anyArgs, Run: sort,
+			Help: "Manipulate the sorting of the aforementioned commands, Call it without arguments for more."},
+		{Name: "add", Aliases: []string{"ad"}, Args: "<URL or magnet>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster,
+			Audit: noSelectors, Run: add,
+			Help: "Takes one or many URLs or magnets to add them, You can send a .torrent file via Telegram to preview it, then add it as is, paused, or with only some of its files.\n" +
+				"Torrents that are already added get reported instead, ones with the same name and size as another can be added paused in its place for cross-seeding."},
+		{Name: "search", Aliases: []string{"se"}, Args: "<query>", MinArgs: 1, MaxArgs: anyArgs, Run: search,
+			Help: "Takes a query and lists torrents with matching names."},
+		{Name: "latest", Aliases: []string{"la"}, Args: "[n]", MaxArgs: 1, Run: latest,
+			Help: "Lists the newest n torrents, n defaults to 5 if no argument is provided."},
+		{Name: "info", Aliases: []string{"in"}, Args: "<ID>...", MinArgs: 1, MaxArgs: anyArgs, Run: info,
+			Help: "Takes one or more torrent's IDs to list more info about them."},
+		{Name: "stop", Aliases: []string{"sp"}, Args: "<ID>... or all", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster,
+			Audit: allSelectors, Run: stop,
+			Help: "Takes one or more torrent's IDs to stop them, or _all_ to stop all torrents."},
+		{Name: "start", Aliases: []string{"st"}, Args: "<ID>... or all", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster,
+			Audit: allSelectors, Run: start,
+			Help: "Takes one or more torrent's IDs to start them, or _all_ to start all torrents."},
+		{Name: "check", Aliases: []string{"ck"}, Args: "<ID>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster,
+			Audit: allSelectors, Run: check,
+			Help: "Takes one or more torrent's IDs to verify them."},
+		{Name: "del", Args: "<ID>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Audit: allSelectors, Run: del,
+			Help: "Takes one or more torrent's IDs to delete them."},
+		{Name: "deldata", Args: "<ID>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Audit: allSelectors, Run: deldata,
+			Help: "Takes one or more torrent's IDs to delete them and their data."},
+		{Name: "trackers", Aliases: []string{"tr"}, Args: "<ID>", MinArgs: 1, MaxArgs: 1, Run: trackers,
+			Help: "Takes a torrent's ID to list its trackers."},
+		{Name: "tracker", Args: "add|remove|replace <selector> <tracker URL>", MinArgs: 3, MaxArgs: anyArgs, Role: RoleMaster,
+			Audit: secondSelector, Selects: selectByTrackerHost, Run: tracker,
+			Help: "Takes _add_, _remove_ or _replace_ followed by a selector and a tracker URL, e.g. \"*tracker add 1,4-6 udp://t.example.org:80*\".\n" +
+				"_replace_ swaps the trackers on the URL's host for it, e.g. for a new passkey; it also takes a tracker host as the selector to replace that host across all torrents.\n" +
+				"_remove_ takes a tracker URL or host, and removes the trackers on that host."},
+		{Name: "reannounce", Aliases: []string{"ra"}, Args: "<selector>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster,
+			Audit: allSelectors, Run: reannounce,
+			Help: "Takes one or more selectors of torrents to force them to reannounce to their trackers."},
+		{Name: "move", Aliases: []string{"mv"}, Args: "<selector> <path>", MinArgs: 2, MaxArgs: anyArgs, Role: RoleMaster,
+			Audit: firstSelector, Run: move,
+			Help: "Takes a selector and a path to move the data of the selected torrents to, reports when the move is done."},
+		{Name: "getfile", Args: "<ID> [file index]...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Run: getfile,
+			Help: "Takes a torrent's ID and optionally file indexes to upload those completed files, several files get zipped, e.g. \"*getfile 3 0 2*\" or \"*getfile 3 0,2*\"."},
+		{Name: "magnet", Args: "<ID>", MinArgs: 1, MaxArgs: 1, Role: RoleMaster, Run: magnet,
+			Help: "Takes a torrent's ID to send its magnet link."},
+		{Name: "torrentfile", Args: "<ID>", MinArgs: 1, MaxArgs: 1, Role: RoleMaster, Run: torrentfile,
+			Help: "Takes a torrent's ID to send its .torrent file, or its magnet link if the file can't be read."},
+		{Name: "export", Args: "json|csv [query]", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Run: export,
+			Help: "Takes _json_ or _csv_ and optionally a query to send the torrents whose name or tracker match it as a file, e.g. \"*export csv example.org*\"."},
+		{Name: "rename", Args: "<ID> <name>", MinArgs: 2, MaxArgs: anyArgs, Role: RoleMaster, Audit: firstSelector, Run: rename,
+			Help: "Takes a torrent's ID and a new name for its file or top folder."},
+		{Name: "renamefile", Args: "<ID> [file index] [path]", MinArgs: 1, MaxArgs: anyArgs,
+			MasterArgs: moreArgsThan(1), // with just an ID it lists the files
+			Audit:      firstSelector, Run: renamefile,
+			Help: "Takes a torrent's ID, a file index and a new path for that file within the torrent, call it with only an ID to list the files."},
+		{Name: "queue", Aliases: []string{"qu"}, Args: "[settings | set <setting> <value>]", MaxArgs: 3,
+			MasterArgs: func(args []string) bool { return len(args) > 0 && strings.ToLower(args[0]) == "set" },
+			Audit:      noSelectors, Run: queue,
+			Help: "Lists queued torrents in queue order, \"*queue settings*\" shows the queue limits and \"*queue set downloading 5*\" changes one of them (_downloading_, _seeding_ or _limit_)."},
+		{Name: "qtop", Args: "<selector>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Audit: allSelectors, Run: queueCommand("top"),
+			Help: "Takes one or more selectors of torrents to move them to the top of the queue."},
+		{Name: "qup", Args: "<selector>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Audit: allSelectors, Run: queueCommand("up"),
+			Help: "Takes one or more selectors of torrents to move them up the queue."},
+		{Name: "qdown", Args: "<selector>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Audit: allSelectors, Run: queueCommand("down"),
+			Help: "Takes one or more selectors of torrents to move them down the queue."},
+		{Name: "qbottom", Args: "<selector>...", MinArgs: 1, MaxArgs: anyArgs, Role: RoleMaster, Audit: allSelectors, Run: queueCommand("bottom"),
+			Help: "Takes one or more selectors of torrents to move them to the bottom of the queue."},
+		{Name: "options", Aliases: []string{"op"}, Args: "<ID> | <selector> <option> <value>", MinArgs: 1, MaxArgs: 3,
+			MasterArgs: moreArgsThan(1), // with just an ID it shows the options
+			Audit:      firstSelector, Run: options,
+			Help: "Takes a torrent's ID to show its seeding options, or a selector, an option and a value to set it, e.g. \"*options 3-5 stop_ratio 2*\".\n" +
+				"Options are _stop_at_ratio_, _stop_ratio_, _remove_at_ratio_, _auto_managed_ and _max_connections_."},
+		{Name: "seedpolicy", Args: "[add <action> <time> [tracker] | del <n>]", MaxArgs: 4, Offline: true,
+			MasterArgs: moreArgsThan(0), Audit: noSelectors, Run: noView(seedpolicy),
+			Help: "Lists the seed time rules, \"*seedpolicy add pause 48h example.org*\" adds one with an optional tracker query, \"*seedpolicy del 1*\" deletes one."},
+		{Name: "hosts", Run: noArgs(hosts),
+			Help: "Lists the daemons known to the Web UI along with their status."},
+		{Name: "connect", Args: "<host>", MinArgs: 1, MaxArgs: 1, Role: RoleMaster, Audit: noSelectors, Run: connect,
+			Help: "Takes a daemon's number as listed by _hosts_, its host[:port] or its ID, to connect the Web UI to it."},
+		{Name: "speed", Aliases: []string{"ss"}, Args: "[all]", MaxArgs: 1, Run: speed,
+			Help: "Shows the upload and download speeds, \"*speed all*\" shows them for every backend."},
+		{Name: "stats", Run: noArgs(stats),
+			Help: "Shows the session's totals, peers, DHT nodes, overhead, free space and incoming connections, along with today's and this month's transfers."},
+		{Name: "graph", Args: "[ID] [span]", MaxArgs: 2, Run: graph,
+			Help: "Sends a chart of the download and upload speeds over the last _1h_, _24h_ (the default) or _7d_, \"*graph 3*\" charts a torrent's progress and speeds."},
+		{Name: "digest", Args: "[now]", MaxArgs: 1, Run: digest,
+			Help: "Shows when the digests of what finished, got added and transferred are sent, \"*digest now*\" sends one right away."},
+		{Name: "count", Aliases: []string{"co"}, Args: "[all]", MaxArgs: 1, Run: count,
+			Help: "Shows the torrents counts per status, \"*count all*\" shows them for every backend."},
+		{Name: "use", Args: "[backend]", MaxArgs: 1, Offline: true, Run: noView(use),
+			Help: "Takes a backend's name to switch this chat to it, lists the backends without an argument."},
+		{Name: "history", Args: "[n] [user]", MaxArgs: 2, Offline: true, Run: noView(history),
+			Help: "Lists the last 10 actions taken through the bot, or n of them, optionally only a user's, e.g. \"*history 20 @user*\"."},
+		{Name: "health", Offline: true, Run: func(view *View, ud tgbotapi.Update, args []string) { health(ud) },
+			Help: "Checks Telegram and every backend's Web UI, session, daemon and free space, and reports each check with its timing."},
+		{Name: "help", Offline: true, Run: func(view *View, ud tgbotapi.Update, args []string) { send(helpText(), ud.Message.Chat.ID, true) },
+			Help: "Shows this help message."},
+		{Name: "version", Run: noArgs(version),
+			Help: "Shows version numbers."},
+	}
+
+	for _, cmd := range commands {
+		commandNames[cmd.Name] = cmd
+		for _, alias := range cmd.Aliases {
+			commandNames[alias] = cmd
+		}
+	}
+}
+
+// commandByName returns the command of a name or alias as it's typed, with or without
+// the leading '/' and the bot's @username that groups add, or nil if there's none.
+func commandByName(name string) *Command {
+	name = strings.TrimPrefix(strings.ToLower(name), "/")
+	if i := strings.Index(name, "@"); i > 0 {
+		name = name[:i]
+	}
+	return commandNames[name]
+}
+
+// helpText lists the commands along with their aliases and help
+func helpText() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("\n")
+	for _, cmd := range commands {
+		buf.WriteString(fmt.Sprintf("\t*%s*", cmd.Name))
+		for _, alias := range cmd.Aliases {
+			buf.WriteString(fmt.Sprintf(" or *%s*", alias))
+		}
+		if cmd.Role == RoleMaster {
+			buf.WriteString(" (master only)")
+		} else if cmd.MasterArgs != nil {
+			buf.WriteString(" (changes are master only)")
+		}
+		buf.WriteString("\n")
+		for _, line := range strings.Split(cmd.Help, "\n") {
+			buf.WriteString("\t" + line + "\n")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString(helpNotes)
+	return buf.String()
+}
+
+// roleFor returns the role that a call of the command with args takes
+func (cmd *Command) roleFor(args []string) Role {
+	if cmd.MasterArgs != nil && cmd.MasterArgs(args) {
+		return RoleMaster
+	}
+	return cmd.Role
+}
+
+// roleOf returns the role of a user, false if the user may use nothing at all
+func roleOf(user *tgbotapi.User) (Role, bool) {
+	if user == nil {
+		return RoleViewer, false
+	}
+
+	name := strings.ToLower(user.UserName)
+	if name == strings.ToLower(Master) {
+		return RoleMaster, true
+	}
+	for _, viewer := range Viewers {
+		if name == strings.ToLower(viewer) {
+			return RoleViewer, true
+		}
+	}
+	return RoleViewer, false
+}
+
+// runCommand checks that the user may run the command and that its arguments fit,
+// then runs it through the audit log; it runs in its own go-routine.
+func runCommand(view *View, ud tgbotapi.Update, cmd *Command, args []string) {
+	chatID := ud.Message.Chat.ID
+
+	// empty arguments come from double spaces
+	var filtered []string
+	for _, arg := range args {
+		if arg != "" {
+			filtered = append(filtered, arg)
+		}
+	}
+	args = filtered
+
+	if role, _ := roleOf(ud.Message.From); role < cmd.roleFor(args) {
+		send(cmd.Name+": only the master can do that", chatID, false)
+		return
+	}
+
+	n := len(args)
+	switch {
+	case n < cmd.MinArgs:
+		send(fmt.Sprintf("%s: needs %s", cmd.Name, cmd.Args), chatID, false)
+		return
+	case cmd.MaxArgs == 0 && n > 0:
+		send(cmd.Name+": takes no arguments", chatID, false)
+		return
+	case cmd.MaxArgs != anyArgs && n > cmd.MaxArgs:
+		send(fmt.Sprintf("%s: takes %s", cmd.Name, cmd.Args), chatID, false)
+		return
+	}
+
+	if !view.Ready() && !cmd.Offline {
+		send(view.Label()+"Deluge unreachable, still trying to connect", chatID, false)
+		return
+	}
+
+	audited(view, ud, cmd, args)
+}
+
+// dispatch runs the command of a message against the chat's backend, or another one if it's prefixed with @name
+func dispatch(ud tgbotapi.Update) {
+	chatID := ud.Message.Chat.ID
+
+	role, ok := roleOf(ud.Message.From)
+	if !ok {
+		log.Printf("[INFO] Ignored a message from: %s", ud.Message.From.String())
+		return
+	}
+
+	// keep track of the chat to send notifications to, unless -chatid is set
+	if role == RoleMaster {
+		atomic.StoreInt64(&lastChatID, chatID)
+	}
+
+	// tokenize the update
+	tokens := strings.Split(ud.Message.Text, " ")
+	command := strings.ToLower(tokens[0])
+
+	// commands run against the chat's backend, unless they're prefixed with @name
+	v := chatView(chatID)
+	if strings.HasPrefix(command, "@") && len(tokens) > 1 {
+		if v = viewByName(command[1:]); v == nil {
+			go send(fmt.Sprintf("no such backend %s, try /use", command[1:]), chatID, false)
+			return
+		}
+		tokens = tokens[1:]
+		command = strings.ToLower(tokens[0])
+	}
+
+	// might be a file received, which only the master may add
+	if command == "" {
+		countCommand(command, true)
+		switch {
+		case role != RoleMaster:
+		case !v.Ready():
+			go send(v.Label()+"Deluge unreachable, still trying to connect", chatID, false)
+		default:
+			go receiveTorrent(v, ud)
+		}
+		return
+	}
+
+	cmd := commandByName(command)
+	if cmd == nil {
+		countCommand(command, false)
+		go send("no such command, try /help", chatID, false)
+		return
+	}
+
+	countCommand(cmd.Name, true)
+	go runCommand(v, ud, cmd, tokens[1:])
+}
+
+// setCommands registers the commands with Telegram, so clients suggest them as '/' gets typed
+func setCommands() {
+	type botCommand struct {
+		Command     string `json:"command"`
+		Description string `json:"description"`
+	}
+
+	var list []botCommand
+	for _, cmd := range commands {
+		// the first sentence, without the markdown
+		description := strings.SplitN(cmd.Help, "\n", 2)[0]
+		if i := strings.Index(description, ". "); i > 0 {
+			description = description[:i+1]
+		}
+		description = strings.NewReplacer("*", "", "_", "").Replace(description)
+		if len(description) > 256 {
+			description = description[:253] + "..."
+		}
+		list = append(list, botCommand{cmd.Name, description})
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] Telegram: %s", err)
+		return
+	}
+	if _, err := Bot.MakeRequest("setMyCommands", url.Values{"commands": {string(data)}}); err != nil {
+		log.Printf("[ERROR] Telegram: setMyCommands: %s", err)
+	}
+}
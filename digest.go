@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// DigestTime is when a digest gets sent, every day or once a week on Weekday.
+type DigestTime struct {
+	Weekly  bool
+	Weekday time.Weekday
+	Hour    int
+	Minute  int
+}
+
+// digestTorrent is what a digest needs to remember about a torrent between reports
+type digestTorrent struct {
+	Name       string  `json:"name"`
+	Progress   float64 `json:"progress"`
+	Done       float64 `json:"done"`
+	Uploaded   float64 `json:"uploaded"`
+	Downloaded float64 `json:"downloaded"`
+	Ratio      float64 `json:"ratio"`
+}
+
+// digestSnapshot is the torrents of a backend as of the last digest
+type digestSnapshot struct {
+	Time     time.Time                 `json:"time"`
+	Torrents map[string]*digestTorrent `json:"torrents"`
+}
+
+var (
+	digestTimes    []*DigestTime
+	digestLocation = time.Local
+
+	// the snapshots of the last digest by backend name
+	digests   = make(map[string]*digestSnapshot)
+	digestsMu sync.Mutex
+
+	digestFields = []string{"name", "state", "progress", "total_done", "total_uploaded", "all_time_download", "ratio", "tracker_status"}
+
+	// how many torrents each section of a digest lists at most
+	digestListLimit = 10
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseDigestTime parses "HH:MM" for a daily digest, or "weekday HH:MM" for a weekly one, e.g. "mon 08:00"
+func parseDigestTime(s string) (*DigestTime, error) {
+	t := &DigestTime{}
+
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 2 {
+		day := fields[0]
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		weekday, ok := weekdays[day]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a weekday", fields[0])
+		}
+		t.Weekly, t.Weekday = true, weekday
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("%s is not in the form of [weekday] HH:MM", s)
+	}
+
+	clock, err := time.Parse("15:04", fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a time of day in the form of HH:MM", fields[0])
+	}
+	t.Hour, t.Minute = clock.Hour(), clock.Minute()
+
+	return t, nil
+}
+
+// String formats the time the same way parseDigestTime takes it
+func (t *DigestTime) String() string {
+	if t.Weekly {
+		return fmt.Sprintf("%s %02d:%02d", t.Weekday.String()[:3], t.Hour, t.Minute)
+	}
+	return fmt.Sprintf("%02d:%02d", t.Hour, t.Minute)
+}
+
+// Next returns the first time after now that the digest is due, in digestLocation
+func (t *DigestTime) Next(now time.Time) time.Time {
+	now = now.In(digestLocation)
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour, t.Minute, 0, 0, digestLocation)
+	if t.Weekly {
+		next = next.AddDate(0, 0, (int(t.Weekday)-int(next.Weekday())+7)%7)
+	}
+
+	for !next.After(now) {
+		if t.Weekly {
+			next = next.AddDate(0, 0, 7)
+		} else {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+// nextDigest returns when the next digest is due, the zero time if there's no schedule
+func nextDigest(now time.Time) time.Time {
+	var next time.Time
+	for _, t := range digestTimes {
+		if n := t.Next(now); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+// digestsFile returns the file the digest snapshots persist to, or "" if there's no -datadir
+func digestsFile() string {
+	if DataDir == "" {
+		return ""
+	}
+	return filepath.Join(DataDir, "digest.json")
+}
+
+// loadDigests reads the persisted digest snapshots, if there are any
+func loadDigests() {
+	file := digestsFile()
+	if file == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Digest: %s", err)
+		}
+		return
+	}
+
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+	if err := json.Unmarshal(data, &digests); err != nil {
+		log.Printf("[ERROR] Digest: %s", err)
+	}
+}
+
+// saveDigests persists the digest snapshots, digestsMu must be held
+func saveDigests() {
+	file := digestsFile()
+	if file == "" {
+		return
+	}
+
+	data, err := json.Marshal(digests)
+	if err != nil {
+		log.Printf("[ERROR] Digest: %s", err)
+		return
+	}
+
+	// write then rename, so a crash never leaves half a file behind
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		log.Printf("[ERROR] Digest: %s", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Printf("[ERROR] Digest: %s", err)
+	}
+}
+
+// takeDigestSnapshot fetches the view's torrents as a digest snapshot, along with the torrents themselves
+func takeDigestSnapshot(v *View) (*digestSnapshot, deluge.Torrents, error) {
+	torrents, err := v.Client.GetTorrents(digestFields...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshot := &digestSnapshot{Time: time.Now(), Torrents: make(map[string]*digestTorrent)}
+	for _, t := range torrents {
+		snapshot.Torrents[t.Hash] = &digestTorrent{
+			Name:       t.Name,
+			Progress:   t.Progress,
+			Done:       t.TotalDone,
+			Uploaded:   t.TotalUploaded,
+			Downloaded: t.AllTimeDownload,
+			Ratio:      t.Ratio,
+		}
+	}
+
+	return snapshot, torrents, nil
+}
+
+// digestLoop keeps a snapshot of every backend to report against, and sends the
+// digests when they're due, it runs in its own go-routine.
+func digestLoop() {
+	loadDigests()
+
+	// the first report of a backend that was never reported on covers the time since the bot started
+	for _, v := range views {
+		digestsMu.Lock()
+		_, ok := digests[v.Name]
+		digestsMu.Unlock()
+		if ok {
+			continue
+		}
+
+		snapshot, _, err := takeDigestSnapshot(v)
+		if err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			continue
+		}
+		digestsMu.Lock()
+		digests[v.Name] = snapshot
+		saveDigests()
+		digestsMu.Unlock()
+	}
+
+	if len(digestTimes) == 0 {
+		return
+	}
+
+	for {
+		next := nextDigest(time.Now())
+		log.Printf("[INFO] Next digest at %s", next.Format(time.RFC1123))
+		if !sleep(time.Until(next)) {
+			return
+		}
+
+		for _, v := range views {
+			report, err := digestReport(v, true)
+			if err != nil {
+				log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+				notify(fmt.Sprintf("%sDigest: %s", v.Label(), err), false)
+				continue
+			}
+			notify(report, true)
+		}
+	}
+}
+
+// digestReport reports on what happened since the last digest, and starts the next
+// one from now if advance is set.
+func digestReport(v *View, advance bool) (string, error) {
+	current, torrents, err := takeDigestSnapshot(v)
+	if err != nil {
+		return "", err
+	}
+
+	// without an earlier snapshot there's nothing to compare against, this one becomes it
+	digestsMu.Lock()
+	last, compare := digests[v.Name]
+	if !compare {
+		last = current
+	}
+	if advance || !compare {
+		digests[v.Name] = current
+		saveDigests()
+	}
+	digestsMu.Unlock()
+
+	type ratioGain struct {
+		name        string
+		gain, ratio float64
+	}
+
+	var (
+		finished, added, trackerErrors, stalled []string
+		transferred                             Transfer
+		gains                                   []ratioGain // since the last digest, biggest first
+	)
+	for _, t := range torrents {
+		now := current.Torrents[t.Hash]
+		name := mdReplacer.Replace(t.Name)
+
+		before, existed := last.Torrents[t.Hash]
+		if !compare {
+			existed = false
+			before = now
+		} else if !existed {
+			added = append(added, name)
+			before = &digestTorrent{}
+		}
+
+		if now.Progress >= 100 && before.Progress < 100 {
+			finished = append(finished, name)
+		}
+
+		// a torrent that got added again starts its totals over, only gains count
+		if up := now.Uploaded - before.Uploaded; up > 0 {
+			transferred.Upload += up
+		}
+		if down := now.Downloaded - before.Downloaded; down > 0 {
+			transferred.Download += down
+		}
+
+		if gain := now.Ratio - before.Ratio; existed && gain > 0 {
+			gains = append(gains, ratioGain{name, gain, now.Ratio})
+			for i := len(gains) - 1; i > 0 && gains[i-1].gain < gains[i].gain; i-- {
+				gains[i-1], gains[i] = gains[i], gains[i-1]
+			}
+		}
+
+		if strings.Contains(t.TrackerStatus, "Error") {
+			trackerErrors = append(trackerErrors, fmt.Sprintf("%s\n  _%s_", name, mdReplacer.Replace(t.TrackerStatus)))
+		}
+
+		if existed && t.State == "Downloading" && now.Done == before.Done {
+			stalled = append(stalled, fmt.Sprintf("%s (%.1f%%)", name, now.Progress))
+		}
+	}
+
+	uploaders := make([]string, 0, len(gains))
+	for _, g := range gains {
+		uploaders = append(uploaders, fmt.Sprintf("%s +%.2f (*%.2f*)", g.name, g.gain, g.ratio))
+	}
+
+	buf := new(bytes.Buffer)
+	if compare {
+		buf.WriteString(fmt.Sprintf("%s*Digest* since %s\n", mdReplacer.Replace(v.Label()), last.Time.In(digestLocation).Format("Mon Jan 2 15:04")))
+	} else {
+		buf.WriteString(fmt.Sprintf("%s*Digest*\nNo earlier snapshot to compare against, the next digest starts from now\n", mdReplacer.Replace(v.Label())))
+	}
+
+	writeSection := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		buf.WriteString(fmt.Sprintf("\n*%s* (%d)\n", title, len(lines)))
+		for i, line := range lines {
+			if i == digestListLimit {
+				buf.WriteString(fmt.Sprintf("and %d more\n", len(lines)-i))
+				break
+			}
+			buf.WriteString(line + "\n")
+		}
+	}
+	writeSection("Finished", finished)
+	writeSection("Added", added)
+
+	buf.WriteString(fmt.Sprintf("\n*Transferred*\n↓ *%s*  ↑ *%s*\n",
+		humanize.Bytes(uint64(transferred.Download)), humanize.Bytes(uint64(transferred.Upload))))
+
+	writeSection("Top uploaders", uploaders)
+	writeSection("Tracker errors", trackerErrors)
+	writeSection("Stalled", stalled)
+
+	if free, err := v.Client.FreeSpace(""); err == nil {
+		buf.WriteString(fmt.Sprintf("\nFree space: *%s*", humanize.Bytes(uint64(free))))
+	} else {
+		log.Printf("[ERROR] Deluge: %s", err)
+	}
+
+	return buf.String(), nil
+}
+
+// digest sends a digest right away with 'now', without starting the next one from now,
+// or shows when digests get sent.
+func digest(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) > 0 && strings.ToLower(tokens[0]) == "now" {
+		report, err := digestReport(view, false)
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			send("digest: "+err.Error(), ud.Message.Chat.ID, false)
+			return
+		}
+		send(report, ud.Message.Chat.ID, true)
+		return
+	}
+
+	if len(digestTimes) == 0 {
+		send("No digests are scheduled, set them with -digest, \"digest now\" sends one right away", ud.Message.Chat.ID, false)
+		return
+	}
+
+	times := make([]string, len(digestTimes))
+	for i, t := range digestTimes {
+		times[i] = t.String()
+	}
+	send(fmt.Sprintf("Digests are sent at %s (%s), the next one on %s\n\"digest now\" sends one right away",
+		strings.Join(times, ", "), digestLocation, nextDigest(time.Now()).Format("Mon Jan 2 15:04")),
+		ud.Message.Chat.ID, false)
+}
+
+// parseDigestTimes parses a comma separated list of digest times
+func parseDigestTimes(s string) ([]*DigestTime, error) {
+	var times []*DigestTime
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+
+		t, err := parseDigestTime(part)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, t)
+	}
+	return times, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	deluge "go-deluge"
+)
+
+// diskState is what the disk checks of a backend know between checks
+type diskState struct {
+	low    map[string]bool // the save paths that are low on space, "" is the default one
+	paused map[string]bool // the torrents that got paused for the lack of space, by hash
+}
+
+var (
+	// alert once a save path has less free space than this, in bytes, no checks if 0
+	MinFree uint64
+	// pause the downloading torrents while a save path is low on space
+	LowSpacePause bool
+
+	// the disk states by backend name
+	diskStates   = make(map[string]*diskState)
+	diskStatesMu sync.Mutex
+
+	// how often the free space gets checked
+	diskInterval = 5 * time.Minute
+)
+
+// pathName names a save path in messages, "" is the default one
+func pathName(path string) string {
+	if path == "" {
+		return "the default download location"
+	}
+	return path
+}
+
+// diskPausedFile returns the file the torrents that got paused for the lack of space persist to,
+// or "" if there's no -datadir, so they still get resumed after a restart.
+func diskPausedFile() string {
+	if DataDir == "" {
+		return ""
+	}
+	return filepath.Join(DataDir, "diskpaused.json")
+}
+
+// loadDiskPaused reads the persisted paused torrents, if there are any
+func loadDiskPaused() {
+	file := diskPausedFile()
+	if file == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Disk: %s", err)
+		}
+		return
+	}
+
+	saved := make(map[string][]string)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("[ERROR] Disk: %s", err)
+		return
+	}
+
+	diskStatesMu.Lock()
+	defer diskStatesMu.Unlock()
+	for name, hashes := range saved {
+		if state, ok := diskStates[name]; ok {
+			for _, hash := range hashes {
+				state.paused[hash] = true
+			}
+		}
+	}
+}
+
+// saveDiskPaused persists the paused torrents, diskStatesMu must be held
+func saveDiskPaused() {
+	file := diskPausedFile()
+	if file == "" {
+		return
+	}
+
+	saved := make(map[string][]string)
+	for name, state := range diskStates {
+		for hash := range state.paused {
+			saved[name] = append(saved[name], hash)
+		}
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Printf("[ERROR] Disk: %s", err)
+		return
+	}
+
+	// write then rename, so a crash never leaves half a file behind
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		log.Printf("[ERROR] Disk: %s", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Printf("[ERROR] Disk: %s", err)
+	}
+}
+
+// watchDisk checks the free space of every backend's save paths every diskInterval,
+// it runs in its own go-routine.
+func watchDisk() {
+	if MinFree == 0 {
+		return
+	}
+
+	diskStatesMu.Lock()
+	for _, v := range views {
+		diskStates[v.Name] = &diskState{low: make(map[string]bool), paused: make(map[string]bool)}
+	}
+	diskStatesMu.Unlock()
+	loadDiskPaused()
+
+	for {
+		for _, v := range views {
+			if err := checkDisk(v); err != nil {
+				log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			}
+		}
+		if !sleep(diskInterval) {
+			return
+		}
+	}
+}
+
+// checkDisk alerts about the view's save paths that run low on space or recover, pauses
+// the downloading torrents while any of them is low if LowSpacePause is set, and resumes
+// the ones it paused once none is.
+func checkDisk(v *View) error {
+	torrents, err := v.Client.GetTorrents("name", "state", "save_path")
+	if err != nil {
+		return err
+	}
+
+	// the default save path, and every other one that's in use
+	paths := []string{""}
+	seen := make(map[string]bool)
+	for _, t := range torrents {
+		if t.SavePath != "" && !seen[t.SavePath] {
+			seen[t.SavePath] = true
+			paths = append(paths, t.SavePath)
+		}
+	}
+
+	diskStatesMu.Lock()
+	defer diskStatesMu.Unlock()
+	state := diskStates[v.Name]
+
+	for _, path := range paths {
+		free, err := v.Client.FreeSpace(path)
+		if err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			continue
+		}
+
+		// a path recovers with a tenth more than the threshold, so it doesn't flap around it
+		switch {
+		case uint64(free) < MinFree && !state.low[path]:
+			state.low[path] = true
+			notify(fmt.Sprintf("%sLow disk space: %s left at %s, below %s", v.Label(),
+				humanize.Bytes(uint64(free)), pathName(path), humanize.Bytes(MinFree)), false)
+		case uint64(free) >= MinFree+MinFree/10 && state.low[path]:
+			delete(state.low, path)
+			notify(fmt.Sprintf("%sDisk space recovered: %s left at %s", v.Label(),
+				humanize.Bytes(uint64(free)), pathName(path)), false)
+		}
+	}
+
+	// forget the paths that are no longer in use
+	for path := range state.low {
+		if path != "" && !seen[path] {
+			delete(state.low, path)
+		}
+	}
+
+	if LowSpacePause {
+		if len(state.low) > 0 {
+			pauseForSpace(v, state, torrents)
+		} else if len(state.paused) > 0 {
+			resumeForSpace(v, state, torrents)
+		}
+	}
+
+	return nil
+}
+
+// pauseForSpace pauses the view's downloading torrents and remembers them, diskStatesMu must be held
+func pauseForSpace(v *View, state *diskState, torrents deluge.Torrents) {
+	var names []string
+	for _, t := range torrents {
+		if t.State != "Downloading" {
+			continue
+		}
+
+		if err := v.Client.PauseTorrent(t.Hash); err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			continue
+		}
+		state.paused[t.Hash] = true
+		names = append(names, t.Name)
+	}
+
+	if len(names) > 0 {
+		saveDiskPaused()
+		log.Printf("[INFO] Paused %d torrents on %s for the lack of disk space", len(names), v.Name)
+		notify(fmt.Sprintf("%sPaused for the lack of disk space:\n%s", v.Label(), strings.Join(names, "\n")), false)
+	}
+}
+
+// resumeForSpace resumes the torrents that pauseForSpace paused and are still paused,
+// diskStatesMu must be held.
+func resumeForSpace(v *View, state *diskState, torrents deluge.Torrents) {
+	var names []string
+	failed := make(map[string]bool) // to try again with the next check
+	for _, t := range torrents {
+		if !state.paused[t.Hash] || t.State != "Paused" {
+			continue
+		}
+
+		if err := v.Client.StartTorrent(t.Hash); err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			failed[t.Hash] = true
+			continue
+		}
+		names = append(names, t.Name)
+	}
+
+	// the ones that got removed or started by someone else are done with as well
+	state.paused = failed
+	saveDiskPaused()
+
+	if len(names) > 0 {
+		log.Printf("[INFO] Resumed %d torrents on %s now that there's disk space", len(names), v.Name)
+		notify(fmt.Sprintf("%sResumed now that there's disk space:\n%s", v.Label(), strings.Join(names, "\n")), false)
+	}
+}
+
+// spaceWarning returns a warning if the torrent is bigger than the free space left at its save path,
+// "" if it isn't or its size isn't known yet.
+func spaceWarning(v *View, torrent *deluge.Torrent) string {
+	if torrent.TotalSize <= 0 {
+		return ""
+	}
+
+	free, err := v.Client.FreeSpace(torrent.SavePath)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		return ""
+	}
+
+	if torrent.TotalSize > float64(free) {
+		return fmt.Sprintf("Warning: %s is %s, but only %s is left at %s", torrent.Name,
+			humanize.Bytes(uint64(torrent.TotalSize)), humanize.Bytes(uint64(free)), pathName(torrent.SavePath))
+	}
+	return ""
+}
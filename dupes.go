@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// torrentMeta is what's known about a torrent before it gets added
+type torrentMeta struct {
+	Hash string  // the info hash in lower case hex
+	Name string  // might be empty for magnets
+	Size float64 // 0 if it isn't known
+}
+
+var (
+	// fetching .torrent files to look into them before they get added
+	fetchClient              = &http.Client{Timeout: 30 * time.Second}
+	maxTorrentFileSize int64 = 10 << 20
+
+	// how many likely duplicates get a cross-seed button
+	maxCrossSeeds = 3
+)
+
+// torrentFileMeta parses the info hash, name and size out of a .torrent file
+func torrentFileMeta(data []byte) (*torrentMeta, error) {
+	mi, err := parseMetainfo(data)
+	if err != nil {
+		return nil, err
+	}
+	return mi.meta(), nil
+}
+
+// fetchTorrent downloads a .torrent file
+func fetchTorrent(link string) ([]byte, error) {
+	resp, err := fetchClient.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxTorrentFileSize + 1})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxTorrentFileSize {
+		return nil, fmt.Errorf("bigger than %s", humanize.Bytes(uint64(maxTorrentFileSize)))
+	}
+	return data, nil
+}
+
+// addURL adds a .torrent file by its URL unless it's already there, or offers to cross-seed it if it
+// looks like a duplicate. files that the bot can't fetch or parse are left for Deluge to fetch.
+// the replies go through rec.
+func addURL(view *View, rec *auditRecorder, chatID int64, link string) {
+	data, err := fetchTorrent(link)
+	var meta *torrentMeta
+	if err == nil {
+		meta, err = torrentFileMeta(data)
+	}
+	if err != nil {
+		log.Printf("[INFO] Leaving %s for Deluge to fetch: %s", path.Base(link), err)
+		hash, err := view.Client.AddTorrentUrl(link)
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			rec.send(err.Error(), chatID, false)
+			return
+		}
+		reportAdded(view, rec, chatID, hash, "")
+		return
+	}
+
+	fileName := path.Base(link)
+	if meta.Name != "" {
+		fileName = meta.Name + ".torrent"
+	}
+	addWith := func(options map[string]interface{}) (string, error) {
+		return view.Client.AddTorrentFile(fileName, base64.StdEncoding.EncodeToString(data), options)
+	}
+	if handleDuplicate(view, rec, chatID, meta, addWith) {
+		return
+	}
+
+	hash, err := addWith(nil)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		rec.send(err.Error(), chatID, false)
+		return
+	}
+	reportAdded(view, rec, chatID, hash, "")
+}
+
+// handleDuplicate reports the torrent that meta is already loaded as, or offers to add it paused at the
+// save path of a torrent with the same name and size for cross-seeding; it returns false if there's
+// neither, so the torrent gets added as usual. the replies go through rec, the buttons get audited on their own.
+func handleDuplicate(view *View, rec *auditRecorder, chatID int64, meta *torrentMeta, addWith func(map[string]interface{}) (string, error)) bool {
+	if err := view.Update("name", "state", "total_size", "tracker_host", "save_path"); err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		return false
+	}
+
+	// the buttons add the torrent of meta
+	added := &deluge.Torrent{Hash: meta.Hash, Name: meta.Name}
+
+	var similar deluge.Torrents
+	for _, torrent := range view.Torrents {
+		if strings.EqualFold(torrent.Hash, meta.Hash) {
+			rec.send(fmt.Sprintf("add: already added as <%d> %s (%s)", torrent.ID, torrent.Name, torrent.State), chatID, false)
+			return true
+		}
+		if meta.Size > 0 && torrent.TotalSize == meta.Size && strings.EqualFold(torrent.Name, meta.Name) {
+			similar = append(similar, torrent)
+		}
+	}
+
+	if len(similar) == 0 {
+		return false
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(fmt.Sprintf("add: %s (%s) looks like a duplicate of:\n", meta.Name, humanize.Bytes(uint64(meta.Size))))
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, torrent := range similar {
+		buf.WriteString(fmt.Sprintf("<%d> %s (%s, %s)\n", torrent.ID, torrent.Name, torrent.TrackerHost, torrent.State))
+		if i >= maxCrossSeeds {
+			continue
+		}
+
+		savePath := torrent.SavePath
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(newAuditedButton(fmt.Sprintf("Cross-seed with <%d>", torrent.ID),
+			view, fmt.Sprintf("add %s (cross-seed with %s)", meta.Name, torrent.Name), deluge.Torrents{added, torrent},
+			func(*tgbotapi.CallbackQuery) string {
+				hash, err := addWith(map[string]interface{}{"add_paused": true, "download_location": savePath})
+				if err != nil {
+					log.Printf("[ERROR] Deluge: %s", err)
+					return err.Error()
+				}
+				reportAdded(view, nil, chatID, hash, "paused at "+savePath)
+				return "Added paused"
+			})))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(newAuditedButton("Add anyway", view, "add "+meta.Name, deluge.Torrents{added},
+		func(*tgbotapi.CallbackQuery) string {
+			hash, err := addWith(nil)
+			if err != nil {
+				log.Printf("[ERROR] Deluge: %s", err)
+				return err.Error()
+			}
+			reportAdded(view, nil, chatID, hash, "")
+			return "Added"
+		})))
+
+	rec.record(buf.String())
+	sendButtons(buf.String(), chatID, false, rows...)
+	return true
+}
+
+// reportAdded records an added torrent with rec and sends its name through it along with a note,
+// and a warning if it doesn't fit
+func reportAdded(view *View, rec *auditRecorder, chatID int64, hash, note string) {
+	torrent, err := view.Client.GetTorrent(hash, addedFields...)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		rec.added(hash, "")
+		rec.send("add: "+err.Error(), chatID, false)
+		return
+	}
+	rec.added(hash, torrent.Name)
+
+	if note != "" {
+		rec.send(fmt.Sprintf("Added: %s, %s", torrent.Name, note), chatID, false)
+	} else {
+		rec.send(fmt.Sprintf("Added: %s", torrent.Name), chatID, false)
+	}
+	if warning := spaceWarning(view, torrent); warning != "" {
+		rec.send(warning, chatID, false)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	deluge "go-deluge"
+)
+
+// eventSubs are the subscribers of a view's events
+type eventSubs struct {
+	sync.Mutex
+	chans map[chan deluge.Event]bool
+}
+
+// Subscribe returns a channel of the view's events along with a function to unsubscribe,
+// events get dropped for subscribers that fall behind.
+func (v *View) Subscribe() (<-chan deluge.Event, func()) {
+	ch := make(chan deluge.Event, 16)
+
+	v.subs.Lock()
+	if v.subs.chans == nil {
+		v.subs.chans = make(map[chan deluge.Event]bool)
+	}
+	v.subs.chans[ch] = true
+	v.subs.Unlock()
+
+	return ch, func() {
+		v.subs.Lock()
+		if v.subs.chans[ch] {
+			delete(v.subs.chans, ch)
+			close(ch)
+		}
+		v.subs.Unlock()
+	}
+}
+
+// dispatchEvents hands the view's events to its subscribers until the bot is stopping,
+// it runs in its own go-routine.
+func (v *View) dispatchEvents() {
+	var lastErr string
+	for event := range v.Client.Events(shutdown) {
+		// Deluge being down would log the same error every second
+		if e, ok := event.(deluge.ErrorEvent); ok {
+			if e.Err.Error() != lastErr {
+				lastErr = e.Err.Error()
+				log.Printf("[ERROR] Deluge %s events: %s", v.Name, lastErr)
+			}
+			continue
+		}
+		lastErr = ""
+
+		v.subs.Lock()
+		for ch := range v.subs.chans {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+		v.subs.Unlock()
+	}
+
+	// no more events are coming, let the subscribers know
+	v.subs.Lock()
+	for ch := range v.subs.chans {
+		delete(v.subs.chans, ch)
+		close(ch)
+	}
+	v.subs.Unlock()
+}
+
+// waitTorrentEvent waits for an event about the torrent with the given hash, or about any torrent
+// if hash is empty, and returns it; or returns nil once timeout passes or the bot is stopping.
+func waitTorrentEvent(events <-chan deluge.Event, hash string, timeout time.Duration) deluge.Event {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-shutdown:
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				events = nil // unsubscribed, just wait for the timeout
+				continue
+			}
+			if e, ok := event.(deluge.TorrentEvent); ok && (hash == "" || e.TorrentHash() == hash) {
+				return event
+			}
+		}
+	}
+}
+
+// notifyEvents notifies about torrents that finish or run into errors, it runs in its own go-routine.
+func notifyEvents(v *View) {
+	events, _ := v.Subscribe()
+	for event := range events {
+		var format string
+		switch e := event.(type) {
+		case deluge.TorrentFinishedEvent:
+			format = "%sFinished: %s"
+		case deluge.TorrentStateChangedEvent:
+			if e.State != "Error" {
+				continue
+			}
+			format = "%sError: %s"
+		default:
+			continue
+		}
+
+		hash := event.(deluge.TorrentEvent).TorrentHash()
+		torrent, err := v.Client.GetTorrent(hash, "name")
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			continue
+		}
+		notify(fmt.Sprintf(format, v.Label(), torrent.Name), false)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// StateDir is Deluge's state directory as Deluge sees it, where it keeps a <hash>.torrent of
+// every torrent; it's found through Deluge's config if it's empty.
+var StateDir string
+
+// magnetURI builds a magnet link out of a torrent's hash, name and trackers
+func magnetURI(torrent *deluge.Torrent) string {
+	query := url.Values{}
+	query.Set("dn", torrent.Name)
+	for _, tracker := range torrent.Trackers {
+		query.Add("tr", tracker.URL)
+	}
+
+	// the hash goes first and unescaped, some clients only look for it there
+	return "magnet:?xt=urn:btih:" + torrent.Hash + "&" + query.Encode()
+}
+
+// exportedTorrent returns the torrent of the ID in tokens, with the fields the exports need
+func exportedTorrent(view *View, tokens []string) (*deluge.Torrent, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("needs a torrent ID")
+	}
+
+	id, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a number", tokens[0])
+	}
+
+	torrent, err := view.GetTorrentByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return view.Client.GetTorrent(torrent.Hash, "name", "trackers")
+}
+
+// magnet sends the magnet link of a torrent
+func magnet(view *View, ud tgbotapi.Update, tokens []string) {
+	torrent, err := exportedTorrent(view, tokens)
+	if err != nil {
+		send("magnet: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	send(magnetURI(torrent), ud.Message.Chat.ID, false)
+}
+
+// torrentFileCandidates returns where Deluge might have kept a torrent's .torrent file, as Deluge sees it:
+// the state directory, and the copies of added .torrent files if Deluge is set to keep them.
+func torrentFileCandidates(view *View, torrent *deluge.Torrent) []string {
+	stateDir := StateDir
+	config, err := view.Client.ConfigValues("plugins_location", "copy_torrent_file", "torrentfiles_location")
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+	}
+
+	// the state directory sits next to the plugins one within Deluge's config directory
+	if plugins, ok := config["plugins_location"].(string); ok && stateDir == "" && plugins != "" {
+		stateDir = path.Join(path.Dir(plugins), "state")
+	}
+
+	var candidates []string
+	if stateDir != "" {
+		candidates = append(candidates, path.Join(stateDir, torrent.Hash+".torrent"))
+	}
+	if copied, _ := config["copy_torrent_file"].(bool); copied {
+		if dir, ok := config["torrentfiles_location"].(string); ok && dir != "" {
+			candidates = append(candidates, path.Join(dir, torrent.Name+".torrent"))
+		}
+	}
+	return candidates
+}
+
+// torrentfile sends the .torrent file of a torrent out of Deluge's state directory, or its
+// magnet link if the file can't be read; Deluge's API doesn't give out the metainfo.
+func torrentfile(view *View, ud tgbotapi.Update, tokens []string) {
+	torrent, err := exportedTorrent(view, tokens)
+	if err != nil {
+		send("torrentfile: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	var problems []string
+	for _, candidate := range torrentFileCandidates(view, torrent) {
+		file := localPath(candidate)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		// a copied .torrent is named after the torrent, make sure it's the same one
+		mi, err := parseMetainfo(data)
+		if err != nil || mi.Hash != strings.ToLower(torrent.Hash) {
+			problems = append(problems, file+" is another torrent's")
+			continue
+		}
+
+		document := tgbotapi.NewDocumentUpload(ud.Message.Chat.ID, tgbotapi.FileBytes{Name: torrent.Name + ".torrent", Bytes: data})
+		if _, err := Bot.Send(document); err != nil {
+			sendFailed(err)
+			send("torrentfile: "+err.Error(), ud.Message.Chat.ID, false)
+		}
+		return
+	}
+
+	if len(problems) == 0 {
+		problems = append(problems, "Deluge's state directory is unknown, set -statedir")
+	}
+	send(fmt.Sprintf("torrentfile: can't read the .torrent (%s), see -statedir and -pathmap. here's its magnet instead:\n%s",
+		strings.Join(problems, "; "), magnetURI(torrent)), ud.Message.Chat.ID, false)
+}
+
+// exportRow is a torrent as the library exports have it
+type exportRow struct {
+	Backend    string  `json:"backend"`
+	Hash       string  `json:"hash"`
+	Name       string  `json:"name"`
+	Size       float64 `json:"size"`
+	State      string  `json:"state"`
+	Ratio      float64 `json:"ratio"`
+	Uploaded   float64 `json:"uploaded"`
+	Downloaded float64 `json:"downloaded"`
+	Tracker    string  `json:"tracker"`
+	Label      string  `json:"label"`
+	SavePath   string  `json:"save_path"`
+	Added      string  `json:"added"`
+	Completed  string  `json:"completed"` // empty if Deluge doesn't tell
+}
+
+var exportFields = []string{"name", "total_size", "state", "ratio", "total_uploaded", "all_time_download",
+	"tracker_host", "label", "save_path", "time_added", "completed_time"}
+
+// exportTime formats a unix time for the exports, nothing for 0
+func exportTime(t float64) string {
+	if t <= 0 {
+		return ""
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+// exportRows returns the view's torrents whose name or tracker matches query, all of them if it's empty
+func exportRows(v *View, query string) ([]*exportRow, error) {
+	// "(?i)" for case insensitivity
+	regx, err := regexp.Compile("(?i)" + query)
+	if err != nil {
+		return nil, err
+	}
+
+	torrents, err := v.Client.GetTorrents(exportFields...)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []*exportRow
+	for _, t := range torrents {
+		if !regx.MatchString(t.Name) && !regx.MatchString(t.TrackerHost) {
+			continue
+		}
+		rows = append(rows, &exportRow{
+			Backend:    v.Name,
+			Hash:       t.Hash,
+			Name:       t.Name,
+			Size:       t.TotalSize,
+			State:      t.State,
+			Ratio:      t.Ratio,
+			Uploaded:   t.TotalUploaded,
+			Downloaded: t.AllTimeDownload,
+			Tracker:    t.TrackerHost,
+			Label:      t.Label,
+			SavePath:   t.SavePath,
+			Added:      exportTime(t.TimeAdded),
+			Completed:  exportTime(t.CompletedTime),
+		})
+	}
+	return rows, nil
+}
+
+// writeExport writes the rows as "json" or "csv"
+func writeExport(w io.Writer, format string, rows []*exportRow) error {
+	switch format {
+	case "json":
+		if rows == nil {
+			rows = []*exportRow{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"backend", "hash", "name", "size", "state", "ratio", "uploaded", "downloaded",
+			"tracker", "label", "save_path", "added", "completed"})
+		num := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+		for _, r := range rows {
+			cw.Write([]string{r.Backend, r.Hash, r.Name, num(r.Size), r.State, strconv.FormatFloat(r.Ratio, 'f', 3, 64),
+				num(r.Uploaded), num(r.Downloaded), r.Tracker, r.Label, r.SavePath, r.Added, r.Completed})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return fmt.Errorf("unknown format %s, use json or csv", format)
+}
+
+// export sends the library, or the torrents whose name or tracker match a query, as a json or csv file
+func export(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		send("export: needs a format, json or csv, and an optional query", ud.Message.Chat.ID, false)
+		return
+	}
+	format := strings.ToLower(tokens[0])
+
+	rows, err := exportRows(view, strings.Join(tokens[1:], " "))
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		send("export: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeExport(buf, format, rows); err != nil {
+		send("export: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s.%s", view.Name, time.Now().Format("2006-01-02"), format)
+	document := tgbotapi.NewDocumentUpload(ud.Message.Chat.ID, tgbotapi.FileBytes{Name: name, Bytes: buf.Bytes()})
+	if _, err := Bot.Send(document); err != nil {
+		sendFailed(err)
+		send("export: "+err.Error(), ud.Message.Chat.ID, false)
+	}
+}
+
+// exportCLI connects to every backend and writes their libraries to stdout, for
+// "deluge-telegram export json|csv [query]", it returns the exit code.
+func exportCLI(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: deluge-telegram export [flags] json|csv [query]\n")
+		return 2
+	}
+	format, query := strings.ToLower(args[0]), strings.Join(args[1:], " ")
+
+	// the arguments are checked before any backend gets logged into
+	if format != "json" && format != "csv" {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %s, use json or csv\n", args[0])
+		return 2
+	}
+	if _, err := regexp.Compile("(?i)" + query); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: query: %s\n", err)
+		return 2
+	}
+
+	for _, v := range views {
+		if err := v.connect(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Deluge %s: %s\n", v.Name, err)
+			return 1
+		}
+	}
+
+	var rows []*exportRow
+	for _, v := range views {
+		r, err := exportRows(v, query)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", v.Name, err)
+			return 1
+		}
+		rows = append(rows, r...)
+	}
+
+	if err := writeExport(os.Stdout, format, rows); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// PathMapping maps a path as Deluge sees it to the same path as the bot sees it,
+// for when they run on different machines or containers.
+type PathMapping struct {
+	Deluge string
+	Local  string
+}
+
+var (
+	PathMap []*PathMapping
+
+	// Telegram's limit on the files bots upload, in bytes
+	UploadLimit uint64 = 50 << 20
+)
+
+// parsePathMap parses a comma separated list of deluge=local path prefixes
+func parsePathMap(s string) ([]*PathMapping, error) {
+	var mappings []*PathMapping
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+
+		paths := strings.SplitN(part, "=", 2)
+		if len(paths) != 2 || paths[0] == "" || paths[1] == "" {
+			return nil, fmt.Errorf("%s is not in the form of deluge-path=local-path", part)
+		}
+		mappings = append(mappings, &PathMapping{path.Clean(paths[0]), filepath.Clean(paths[1])})
+	}
+	return mappings, nil
+}
+
+// localPath maps a path as Deluge sees it to the bot's side, the longest matching prefix wins
+// and paths that match none are taken as they are.
+func localPath(p string) string {
+	p = path.Clean(p)
+
+	var best *PathMapping
+	for _, m := range PathMap {
+		// a mapping of "/" is the only prefix that already ends with a '/'
+		prefix := strings.TrimSuffix(m.Deluge, "/") + "/"
+		if (p == m.Deluge || strings.HasPrefix(p, prefix)) && (best == nil || len(m.Deluge) > len(best.Deluge)) {
+			best = m
+		}
+	}
+	if best == nil {
+		return filepath.FromSlash(p)
+	}
+	return filepath.Join(best.Local, filepath.FromSlash(strings.TrimPrefix(p, best.Deluge)))
+}
+
+// filePath returns the local path of a torrent's file, it fails if the file's path, which
+// can be renamed to anything, leads out of the torrent's save path.
+func filePath(savePath string, f *deluge.File) (string, error) {
+	dir := path.Clean(savePath)
+	p := path.Join(dir, f.Path)
+	if !strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+		return "", fmt.Errorf("%s is outside of the save path %s", f.Path, dir)
+	}
+	return localPath(p), nil
+}
+
+// getfile uploads a torrent's completed file to the chat, or zips several of them
+// into a single upload if they fit Telegram's limit.
+func getfile(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		send("getfile: needs a torrent ID, and optionally file indexes", ud.Message.Chat.ID, false)
+		return
+	}
+
+	id, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		send(fmt.Sprintf("getfile: %s is not a number", tokens[0]), ud.Message.Chat.ID, false)
+		return
+	}
+
+	torrent, err := view.GetTorrentByID(id)
+	if err != nil {
+		send("getfile: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+	torrent, err = view.Client.GetTorrent(torrent.Hash, "name", "save_path", "files", "file_progress")
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		send("getfile: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	// the chosen files, each once, the indexes may be comma separated as well
+	var files []*deluge.File
+	chosen := make(map[int]bool)
+	for _, token := range strings.Split(strings.Join(tokens[1:], ","), ",") {
+		if token == "" {
+			continue
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(torrent.Files) {
+			send(fmt.Sprintf("getfile: %s is not a file index of %s, see renamefile %d", token, torrent.Name, id),
+				ud.Message.Chat.ID, false)
+			return
+		}
+		if !chosen[index] {
+			chosen[index] = true
+			files = append(files, torrent.Files[index])
+		}
+	}
+	if len(files) == 0 {
+		files = torrent.Files // none chosen, all of them
+	}
+
+	var size float64
+	for _, f := range files {
+		if f.Index < len(torrent.FileProgress) && torrent.FileProgress[f.Index] < 1 {
+			send(fmt.Sprintf("getfile: %s isn't complete yet", f.Path), ud.Message.Chat.ID, false)
+			return
+		}
+		size += f.Size
+	}
+
+	if uint64(size) > UploadLimit {
+		buf := new(bytes.Buffer)
+		buf.WriteString(fmt.Sprintf("getfile: %s is more than the upload limit of %s, pick smaller files:\n",
+			humanize.Bytes(uint64(size)), humanize.Bytes(UploadLimit)))
+		for i, f := range torrent.Files {
+			if i == 20 {
+				buf.WriteString(fmt.Sprintf("and %d more\n", len(torrent.Files)-i))
+				break
+			}
+			buf.WriteString(fmt.Sprintf("<%d> %s (%s)\n", f.Index, f.Path, humanize.Bytes(uint64(f.Size))))
+		}
+		send(buf.String(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	// a single file goes as it is, several get zipped
+	var document tgbotapi.DocumentConfig
+	if len(files) == 1 {
+		file, err := filePath(torrent.SavePath, files[0])
+		if err != nil {
+			send("getfile: "+err.Error(), ud.Message.Chat.ID, false)
+			return
+		}
+		if _, err := os.Stat(file); err != nil {
+			send(fmt.Sprintf("getfile: can't read %s, see -pathmap: %s", file, err), ud.Message.Chat.ID, false)
+			return
+		}
+		document = tgbotapi.NewDocumentUpload(ud.Message.Chat.ID, file)
+	} else {
+		data, err := zipFiles(torrent.SavePath, files)
+		if err != nil {
+			send("getfile: "+err.Error(), ud.Message.Chat.ID, false)
+			return
+		}
+		if uint64(len(data)) > UploadLimit {
+			send(fmt.Sprintf("getfile: the zip is %s, more than the upload limit of %s",
+				humanize.Bytes(uint64(len(data))), humanize.Bytes(UploadLimit)), ud.Message.Chat.ID, false)
+			return
+		}
+		document = tgbotapi.NewDocumentUpload(ud.Message.Chat.ID, tgbotapi.FileBytes{Name: torrent.Name + ".zip", Bytes: data})
+	}
+
+	// uploads take a while, let the chat know
+	Bot.Send(tgbotapi.NewChatAction(ud.Message.Chat.ID, tgbotapi.ChatUploadDocument))
+	if _, err := Bot.Send(document); err != nil {
+		sendFailed(err)
+		send("getfile: "+err.Error(), ud.Message.Chat.ID, false)
+	}
+}
+
+// zipFiles zips the files of a torrent saved at savePath, their paths within the torrent are kept
+func zipFiles(savePath string, files []*deluge.File) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for _, f := range files {
+		file, err := filePath(savePath, f)
+		if err != nil {
+			return nil, err
+		}
+		if err := zipFile(zw, file, f.Path); err != nil {
+			return nil, fmt.Errorf("can't read %s, see -pathmap: %s", file, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// zipFile adds the file to the zip by name
+func zipFile(zw *zip.Writer, file, name string) error {
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	deluge "go-deluge"
+)
+
+func TestLocalPath(t *testing.T) {
+	defer func(m []*PathMapping) { PathMap = m }(PathMap)
+
+	var err error
+	PathMap, err = parsePathMap("/=/mnt/remote,/downloads=/data,/downloads/tv=/tv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ path, want string }{
+		{"/downloads/a.mkv", "/data/a.mkv"},
+		{"/downloads", "/data"},
+		{"/downloads/tv/show/e01.mkv", "/tv/show/e01.mkv"}, // the longest prefix wins
+		{"/downloadsx/a.mkv", "/mnt/remote/downloadsx/a.mkv"},
+		{"/other/b.iso", "/mnt/remote/other/b.iso"},
+		{"/", "/mnt/remote"},
+		{"relative/c.txt", "relative/c.txt"},
+	}
+	for _, test := range tests {
+		if got := localPath(test.path); got != filepath.FromSlash(test.want) {
+			t.Errorf("localPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestFilePath(t *testing.T) {
+	defer func(m []*PathMapping) { PathMap = m }(PathMap)
+	PathMap = nil
+
+	tests := []struct {
+		savePath, path, want string
+	}{
+		{"/downloads", "dir/a.mkv", "/downloads/dir/a.mkv"},
+		{"/downloads/", "a.mkv", "/downloads/a.mkv"},
+		{"/", "a.mkv", "/a.mkv"},
+		{"/downloads", "dir/../a.mkv", "/downloads/a.mkv"},
+		{"/downloads", "../../etc/passwd", ""},
+		{"/downloads", "../downloads2/a.mkv", ""},
+		{"/downloads", "..", ""},
+	}
+	for _, test := range tests {
+		got, err := filePath(test.savePath, &deluge.File{Path: test.path})
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("filePath(%q, %q) = %q, want an error", test.savePath, test.path, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(test.want) {
+			t.Errorf("filePath(%q, %q) = %q, %v, want %q", test.savePath, test.path, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// healthCheck is the outcome of a single check
+type healthCheck struct {
+	Name   string
+	Took   time.Duration
+	Detail string
+	Err    error
+}
+
+// healthReport is the outcome of every check
+type healthReport []*healthCheck
+
+var (
+	// reachClient checks that the Web UIs answer at all
+	reachClient = &http.Client{Timeout: 10 * time.Second}
+
+	// how long /healthz serves the same report, so frequent probes don't turn into load on Telegram and Deluge
+	healthzTTL = 30 * time.Second
+
+	healthzMu     sync.Mutex
+	healthzReport healthReport
+	healthzTime   time.Time
+)
+
+// check runs f as the check of name and keeps its outcome, it returns whether it passed
+func (r *healthReport) check(name string, f func() (string, error)) bool {
+	start := time.Now()
+	detail, err := f()
+	*r = append(*r, &healthCheck{Name: name, Took: time.Since(start), Detail: detail, Err: err})
+	return err == nil
+}
+
+// failed returns how many checks failed
+func (r healthReport) failed() int {
+	var n int
+	for _, c := range r {
+		if c.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// String formats the report, a line for every check
+func (r healthReport) String() string {
+	buf := new(bytes.Buffer)
+	if n := r.failed(); n > 0 {
+		buf.WriteString(fmt.Sprintf("Health: %d of %d checks failed\n", n, len(r)))
+	} else {
+		buf.WriteString(fmt.Sprintf("Health: all %d checks passed\n", len(r)))
+	}
+
+	for _, c := range r {
+		took := c.Took.Round(time.Millisecond)
+		switch {
+		case c.Err != nil:
+			buf.WriteString(fmt.Sprintf("FAIL %s (%s): %s\n", c.Name, took, c.Err))
+		case c.Detail != "":
+			buf.WriteString(fmt.Sprintf("OK %s (%s): %s\n", c.Name, took, c.Detail))
+		default:
+			buf.WriteString(fmt.Sprintf("OK %s (%s)\n", c.Name, took))
+		}
+	}
+	return buf.String()
+}
+
+// checkHealth checks Telegram, and the Web UI, session, daemon and free space of every backend
+func checkHealth() healthReport {
+	var r healthReport
+
+	r.check("Telegram getMe", func() (string, error) {
+		me, err := Bot.GetMe()
+		if err != nil {
+			return "", err
+		}
+		return "@" + me.UserName, nil
+	})
+
+	for _, v := range views {
+		checkViewHealth(&r, v)
+	}
+	return r
+}
+
+// checkViewHealth checks a backend, the checks that need the Web UI are skipped if it can't be reached
+func checkViewHealth(r *healthReport, v *View) {
+	label := v.Label()
+
+	ok := r.check(label+"Web UI reachable", func() (string, error) {
+		resp, err := reachClient.Get(v.URL)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return "", fmt.Errorf("%s", resp.Status)
+		}
+		return v.URL, nil
+	})
+	if !ok {
+		return
+	}
+
+	// web.connected logs in if the session expired, so the session check after it tells if logging in works
+	r.check(label+"Daemon connected (web.connected)", func() (string, error) {
+		connected, err := v.Client.Connected()
+		if err == nil && !connected {
+			err = fmt.Errorf("the Web UI is not connected to a daemon")
+		}
+		return "", err
+	})
+	r.check(label+"Session (auth.check_session)", func() (string, error) {
+		valid, err := v.Client.CheckSession()
+		if err == nil && !valid {
+			err = fmt.Errorf("not logged in, check the password")
+		}
+		return "", err
+	})
+
+	r.check(label+"Daemon version", func() (string, error) {
+		delugeVersion, libtorrent, err := v.Client.Version()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Deluge %s, libtorrent %s", delugeVersion, libtorrent), nil
+	})
+	r.check(label+"RPC round trip", func() (string, error) {
+		_, _, err := v.Client.SpeedRate()
+		return "", err
+	})
+
+	r.check(label+"Free space", func() (string, error) {
+		free, err := v.Client.FreeSpace("")
+		if err != nil {
+			return "", err
+		}
+		if uint64(free) < MinFree {
+			return "", fmt.Errorf("%s left at %s, below %s", humanize.Bytes(uint64(free)), pathName(""), humanize.Bytes(MinFree))
+		}
+		return fmt.Sprintf("%s left at %s", humanize.Bytes(uint64(free)), pathName("")), nil
+	})
+}
+
+// health checks Telegram and every backend, and reports each check with its timing
+func health(ud tgbotapi.Update) {
+	send(checkHealth().String(), ud.Message.Chat.ID, false)
+}
+
+// healthzHandler serves the health report, with 503 if any check failed; the report is
+// checked again once it's older than healthzTTL, probes that come meanwhile wait for it.
+func healthzHandler(rw http.ResponseWriter, r *http.Request) {
+	healthzMu.Lock()
+	if healthzReport == nil || time.Since(healthzTime) > healthzTTL {
+		healthzReport, healthzTime = checkHealth(), time.Now()
+	}
+	report := healthzReport
+	healthzMu.Unlock()
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if report.failed() > 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(rw, report)
+}
+
+// startupReport checks the health once the bot starts, and sends the masters the report
+func startupReport() {
+	report := checkHealth()
+	for _, line := range strings.Split(strings.TrimSpace(report.String()), "\n") {
+		log.Printf("[INFO] %s", line)
+	}
+	notify(fmt.Sprintf("Bot started, deluge-telegram %s\n%s", VERSION, report), false)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+var (
+	// how long to wait between connection attempts, it doubles after every failure up to retryMax
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+
+	// how long a shutdown waits for the live messages to be finalized and the state to be saved
+	shutdownTimeout = 10 * time.Second
+
+	// closed once the bot is asked to stop
+	shutdown = make(chan struct{})
+
+	// the live messages that are still being updated
+	liveMessages sync.WaitGroup
+
+	// the background loops, they save what they keep once the bot is stopping
+	backgroundLoops sync.WaitGroup
+
+	// held while adding to the wait groups that stopBot waits on, so nothing gets added once it waits
+	holdMu sync.Mutex
+)
+
+// retry calls f until it succeeds, waiting longer after each failure, it returns
+// false if the bot is asked to stop first.
+func retry(what string, f func() error) bool {
+	wait := retryMin
+	for {
+		err := f()
+		if err == nil {
+			return true
+		}
+		log.Printf("[ERROR] %s: %s, retrying in %s", what, err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-shutdown:
+			return false
+		}
+		if wait *= 2; wait > retryMax {
+			wait = retryMax
+		}
+	}
+}
+
+// setupBackends makes a view for every backend, they get connected by connect
+func setupBackends() {
+	for _, b := range Backends {
+		client := deluge.NewClient(b.URL+"/json", b.Password)
+		client.OnRequest = observeRPC(b.Name)
+		views = append(views, &View{Name: b.Name, URL: b.URL, Client: client, daemon: b.Daemon})
+	}
+}
+
+// connect logs into the view's Web UI and connects it to its daemon, the view is ready once it's logged in
+func (v *View) connect() error {
+	if err := v.Client.Login(); err != nil {
+		return err
+	}
+
+	// the daemon might not be up yet, it gets connected again once it's needed
+	if v.daemon != "" {
+		if err := v.Client.AutoConnect(v.daemon); err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+		}
+	}
+
+	atomic.StoreInt32(&v.ready, 1)
+	return nil
+}
+
+// Ready reports whether the view's Web UI has been reached since the bot started
+func (v *View) Ready() bool {
+	return atomic.LoadInt32(&v.ready) == 1
+}
+
+// reconnect keeps trying to connect a view that couldn't be reached at startup, and tells
+// the masters once it's reached; it runs in its own go-routine.
+func (v *View) reconnect() {
+	start := time.Now()
+	if retry("Deluge "+v.Name, v.connect) {
+		log.Printf("[INFO] Deluge %s: connected after %s", v.Name, time.Since(start).Truncate(time.Second))
+		notify(fmt.Sprintf("%sDeluge reachable, connected after %s", v.Label(), time.Since(start).Truncate(time.Second)), false)
+	}
+}
+
+// connectTelegram authorizes the bot and starts receiving updates, retrying until Telegram
+// can be reached; it returns false if the bot is asked to stop first.
+func connectTelegram() bool {
+	ok := retry("Telegram", func() (err error) {
+		Bot, err = tgbotapi.NewBotAPI(BotToken)
+		return err
+	})
+	if !ok {
+		return false
+	}
+	log.Printf("[INFO] Authorized: %s", Bot.Self.UserName)
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+
+	// this never fails as of now, the updates get retried on their own
+	var err error
+	if Updates, err = Bot.GetUpdatesChan(u); err != nil {
+		log.Printf("[ERROR] Telegram: %s", err)
+		return false
+	}
+	return true
+}
+
+// handleSignals closes shutdown on SIGINT or SIGTERM, it runs in its own go-routine.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("[INFO] Got %s, shutting down", sig)
+	close(shutdown)
+
+	// a second one doesn't wait
+	sig = <-signals
+	log.Printf("[INFO] Got %s again, exiting", sig)
+	os.Exit(1)
+}
+
+// stopBot stops receiving updates and waits for the live messages to show they're done,
+// for the audit log entries that wait for follow-ups to be written, and for the background
+// loops to save what they keep.
+func stopBot() {
+	Bot.StopReceivingUpdates()
+
+	// shutdown is closed, nothing gets held from now on
+	holdMu.Lock()
+	holdMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		liveMessages.Wait()
+		pendingAudits.Wait()
+		backgroundLoops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("[INFO] Stopped")
+	case <-time.After(shutdownTimeout):
+		log.Printf("[INFO] Stopped without finalizing every live message or saving everything")
+	}
+}
+
+// hold adds one to wg, one of the wait groups that stopBot waits on, unless the bot is stopping;
+// it reports whether it did.
+func hold(wg *sync.WaitGroup) bool {
+	holdMu.Lock()
+	defer holdMu.Unlock()
+	if stopping() {
+		return false
+	}
+	wg.Add(1)
+	return true
+}
+
+// background runs a loop in its own go-routine, stopBot waits for it to return
+func background(loop func()) {
+	if !hold(&backgroundLoops) {
+		return
+	}
+	go func() {
+		defer backgroundLoops.Done()
+		loop()
+	}()
+}
+
+// sleep waits for d, it returns false once the bot is stopping.
+func sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-shutdown:
+		return false
+	}
+}
+
+// liveSleep waits for the next update of a live message, it returns false once the
+// bot is stopping so the message gets finalized right away.
+func liveSleep() bool {
+	return sleep(time.Second * interval)
+}
+
+// stopping reports whether the bot is stopping
+func stopping() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
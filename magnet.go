@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Magnet is what's in a magnet link
+type Magnet struct {
+	Hash     string // the v1 info hash in lower case hex, empty for v2 only magnets
+	HashV2   string // the v2 info hash's multihash in lower case hex, if there's one
+	Name     string
+	Size     float64 // 0 if it isn't known
+	Trackers []string
+}
+
+// how long to wait for the metadata of an added magnet before giving up on reporting it
+var metadataTimeout = 10 * time.Minute
+
+// parseMagnet parses a magnet link, it takes the first valid hash of each version out of its xt's
+func parseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "magnet" {
+		return nil, fmt.Errorf("%s is not a magnet link", link)
+	}
+	query := u.Query()
+
+	m := &Magnet{Name: query.Get("dn"), Trackers: query["tr"]}
+	if xl, err := strconv.ParseFloat(query.Get("xl"), 64); err == nil {
+		m.Size = xl
+	}
+
+	for _, xt := range query["xt"] {
+		switch {
+		case strings.HasPrefix(strings.ToLower(xt), "urn:btih:") && m.Hash == "":
+			// the hash is either 40 hex characters or 32 base32 ones
+			hash := xt[len("urn:btih:"):]
+			switch len(hash) {
+			case 40:
+				if _, err := hex.DecodeString(hash); err == nil {
+					m.Hash = strings.ToLower(hash)
+				}
+			case 32:
+				if b, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash)); err == nil {
+					m.Hash = hex.EncodeToString(b)
+				}
+			}
+		case strings.HasPrefix(strings.ToLower(xt), "urn:btmh:") && m.HashV2 == "":
+			hash := xt[len("urn:btmh:"):]
+			if _, err := hex.DecodeString(hash); err == nil {
+				m.HashV2 = strings.ToLower(hash)
+			}
+		}
+	}
+
+	if m.Hash == "" && m.HashV2 == "" {
+		return nil, fmt.Errorf("magnet has no valid info hash")
+	}
+	return m, nil
+}
+
+// meta returns what duplicate checks need to know about the magnet
+func (m *Magnet) meta() *torrentMeta {
+	return &torrentMeta{Hash: m.Hash, Name: m.Name, Size: m.Size}
+}
+
+// String formats the magnet's name, or its hash if it has none, and trackers for a message
+func (m *Magnet) String() string {
+	buf := new(bytes.Buffer)
+	switch {
+	case m.Name != "":
+		buf.WriteString(m.Name)
+	case m.Hash != "":
+		buf.WriteString(m.Hash)
+	default:
+		buf.WriteString(m.HashV2)
+	}
+	if m.Size > 0 {
+		buf.WriteString(fmt.Sprintf(" (%s)", humanize.Bytes(uint64(m.Size))))
+	}
+	buf.WriteString("\n")
+
+	for i, tracker := range m.Trackers {
+		if i == 5 {
+			buf.WriteString(fmt.Sprintf("and %d more trackers\n", len(m.Trackers)-i))
+			break
+		}
+		buf.WriteString(fmt.Sprintf("Tracker: %s\n", tracker))
+	}
+	return buf.String()
+}
+
+// addMagnet adds a magnet unless it's already there, or offers to cross-seed it if it looks like
+// a duplicate, then reports its name and size once its metadata arrives; the replies go through rec.
+func addMagnet(view *View, rec *auditRecorder, chatID int64, link string) {
+	m, err := parseMagnet(link)
+	if err != nil {
+		rec.send("add: "+err.Error(), chatID, false)
+		return
+	}
+
+	addWith := func(options map[string]interface{}) (string, error) {
+		return view.Client.AddTorrentMagnet(link, options)
+	}
+	// v2 only magnets have no hash to compare
+	if m.Hash != "" && handleDuplicate(view, rec, chatID, m.meta(), addWith) {
+		return
+	}
+
+	hash, err := addWith(nil)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		rec.send(err.Error(), chatID, false)
+		return
+	}
+	rec.added(hash, m.Name)
+
+	// the wait might be long, the add itself is done
+	msgID := rec.send("Added: "+m.String()+"Waiting for metadata…", chatID, false)
+	rec.followUp()
+	go waitMetadata(view, rec, chatID, msgID, hash, m)
+}
+
+// waitMetadata keeps watching an added magnet until its metadata arrives, and edits the
+// message of msgID with the torrent's real name, size and number of files; it's a follow-up of rec.
+func waitMetadata(view *View, rec *auditRecorder, chatID int64, msgID int, hash string, m *Magnet) {
+	defer rec.done()
+
+	edit := func(text string) {
+		rec.record(text)
+		editConf := tgbotapi.NewEditMessageText(chatID, msgID, text)
+		if _, err := Bot.Send(editConf); err != nil {
+			sendFailed(err)
+		}
+	}
+
+	start := time.Now()
+	for time.Since(start) < metadataTimeout {
+		if !liveSleep() {
+			rec.record("Bot stopped before the metadata arrived")
+			return
+		}
+
+		torrent, err := view.Client.GetTorrent(hash, "name", "state", "total_size", "num_files", "save_path")
+		if err != nil {
+			// it got removed, or Deluge is down for a bit
+			if strings.HasPrefix(err.Error(), "No such torrent") {
+				edit("Added: " + m.String() + "Removed before its metadata arrived")
+				return
+			}
+			log.Printf("[ERROR] Deluge: %s", err)
+			continue
+		}
+
+		// there are no files until the metadata arrives
+		if torrent.NumFiles == 0 || torrent.TotalSize == 0 {
+			continue
+		}
+
+		text := fmt.Sprintf("Added: %s\n%s in %d files, metadata took %s", torrent.Name,
+			humanize.Bytes(uint64(torrent.TotalSize)), torrent.NumFiles, time.Since(start).Truncate(time.Second))
+		if warning := spaceWarning(view, torrent); warning != "" {
+			text += "\n" + warning
+		}
+		edit(text)
+		return
+	}
+
+	edit(fmt.Sprintf("Added: %sNo metadata after %s, it's still there waiting for peers that have it",
+		m.String(), metadataTimeout))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	const (
+		hexHash = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+		// the same hash in base32
+		b32Hash = "YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK"
+		btmh    = "1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	)
+
+	tests := []struct {
+		link string
+		want *Magnet
+	}{
+		{
+			link: "magnet:?xt=urn:btih:" + hexHash,
+			want: &Magnet{Hash: hexHash},
+		},
+		{
+			link: "magnet:?xt=urn:btih:C12FE1C06BBA254A9DC9F519B335AA7C1367A88A&dn=Some+Name&xl=1024",
+			want: &Magnet{Hash: hexHash, Name: "Some Name", Size: 1024},
+		},
+		{
+			link: "magnet:?xt=urn:btih:" + b32Hash + "&tr=udp%3A%2F%2Fa.ex%3A80&tr=http%3A%2F%2Fb.ex%2Fann",
+			want: &Magnet{Hash: hexHash, Trackers: []string{"udp://a.ex:80", "http://b.ex/ann"}},
+		},
+		{
+			link: "magnet:?xt=urn:btih:" + b32Hash[:31] + "1&xt=urn:btih:" + hexHash, // the first isn't base32
+			want: &Magnet{Hash: hexHash},
+		},
+		{
+			link: "magnet:?xt=urn:btmh:" + btmh,
+			want: &Magnet{HashV2: btmh},
+		},
+		{
+			link: "magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:" + btmh + "&dn=hybrid",
+			want: &Magnet{Hash: hexHash, HashV2: btmh, Name: "hybrid"},
+		},
+	}
+
+	for _, test := range tests {
+		m, err := parseMagnet(test.link)
+		if err != nil {
+			t.Errorf("parseMagnet(%q): %s", test.link, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, test.want) {
+			t.Errorf("parseMagnet(%q) = %+v, want %+v", test.link, m, test.want)
+		}
+	}
+
+	for _, link := range []string{
+		"",
+		"http://example.org/a.torrent",
+		"magnet:?dn=no+hash",
+		"magnet:?xt=urn:btih:" + hexHash[:39],
+		"magnet:?xt=urn:btih:" + hexHash[:39] + "g",
+		"magnet:?xt=urn:btmh:zz",
+	} {
+		if m, err := parseMagnet(link); err == nil {
+			t.Errorf("parseMagnet(%q) = %+v, want an error", link, m)
+		}
+	}
+}
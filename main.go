@@ -5,10 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -19,105 +22,49 @@ import (
 	"gopkg.in/telegram-bot-api.v4"
 )
 
-const (
-	VERSION = "1.0"
-	HELP    = `
-	*list* or *li*
-	Lists all the torrents, takes an optional argument which is a query to list only torrents that has a tracker matches the query, or some of it.
-
-	*head* or *he*
-	Lists the first n number of torrents, n defaults to 5 if no argument is provided.
-
-	*tail* or *ta*
-	Lists the last n number of torrents, n defaults to 5 if no argument is provided.
-
-	*down* or *dl*
-	Lists torrents with the status of Downloading or in the queue to download.
-
-	*seeding* or *sd*
-	Lists torrents with the status of Seeding or in the queue to seed.
-	
-	*paused* or *pa*
-	Lists Paused torrents.
-
-	*checking* or *ch*
-	Lists torrents with the status of Verifying or in the queue to verify.
-	
-	*active* or *ac*
-	Lists torrents that are actively uploading or downloading.
-
-	*errors* or *er*
-	Lists torrents with with errors along with the error message.
-
-	*sort* or *so*
-	Manipulate the sorting of the aforementioned commands, Call it without arguments for more. 
-
-	*add* or *ad*
-	Takes one or many URLs or magnets to add them, You can send a .torrent file via Telegram to add it.
-
-	*search* or *se*
-	Takes a query and lists torrents with matching names.
-
-	*latest* or *la*
-	Lists the newest n torrents, n defaults to 5 if no argument is provided.
-
-	*info* or *in*
-	Takes one or more torrent's IDs to list more info about them.
-
-	*stop* or *sp*
-	Takes one or more torrent's IDs to stop them, or _all_ to stop all torrents.
-
-	*start* or *st*
-	Takes one or more torrent's IDs to start them, or _all_ to start all torrents.
-
-	*check* or *ck*
-	Takes an ID of a torrent to verify.
-
-	*del*
-	Takes one or more torrent's IDs to delete them.
-
-	*deldata*
-	Takes one or more torrent's IDs to delete them and their data.
-
-	*speed* or *ss*
-	Shows the upload and download speeds.
-	
-	*count* or *co*
-	Shows the torrents counts per status.
-
-	*help*
-	Shows this help message.
-
-	*version*
-	Shows version numbers.
-
-	- Prefix commands with '/' if you want to talk to your bot in a group. 
-	- report any issues [here](https://github.com/pyed/deluge-telegram)
-	`
-)
+const VERSION = "1.0"
 
 var (
 	// flags
 	BotToken  string
 	Master    string
 	DelugeURL string
+	Daemon    string
 	Password  string
 	LogFile   string
+	MoveDirs  []string
+	ChatID    int64
+	Config    string
+	Notify    bool
+	DataDir   string
 
-	// Deluge
-	Client *deluge.Deluge
+	// the subcommand to run instead of the bot, e.g. "export"
+	Subcommand string
 
-	// Deluge view
-	view = new(View)
+	// Deluge instances
+	Backends []*Backend
 
 	// Telegram
 	Bot     *tgbotapi.BotAPI
 	Updates <-chan tgbotapi.Update
 
+	// the last chat the master talked in, notifications go there if ChatID isn't set
+	lastChatID int64
+
 	// interval in seconds for live updates, affects: "active", "info", "speed", "head", "tail"
 	interval time.Duration = 2
 	// duration controls how many intervals will happen
 	duration = 60
+	// moveTimeout is how long to wait for a move to finish before giving up on reporting it
+	moveTimeout = time.Hour
+
+	// the torrent fields that the views need, so they don't fetch every field of every torrent
+	listFields  = []string{"name", "tracker_host"}
+	stateFields = []string{"name", "state"}
+	liveFields  = []string{"name", "state", "progress", "download_payload_rate", "upload_payload_rate", "ratio"}
+	infoFields  = []string{"name", "state", "progress", "download_payload_rate", "upload_payload_rate",
+		"all_time_download", "total_uploaded", "ratio", "time_added", "eta", "tracker_host"}
+	addedFields = []string{"name", "total_size", "save_path"} // the report of an added torrent and its space warning
 
 	// since telegram's markdown can't be escaped, we have to replace some chars
 	mdReplacer = strings.NewReplacer("*", "•",
@@ -127,22 +74,49 @@ var (
 		"`", "'")
 )
 
-// init flags
-func init() {
+// parseFlags parses the flags and the environment variables, and sets the log up
+func parseFlags() {
 	// define arguments and parse them.
 	flag.StringVar(&BotToken, "token", "", "Telegram bot token, set it via TOKEN=")
 	flag.StringVar(&Master, "master", "", "Your telegram handler, So the bot will only respond to you, set it via MASTER=")
 	flag.StringVar(&DelugeURL, "url", "http://localhost:8112", "Deluge WebUI URL")
 	flag.StringVar(&Password, "password", "", "Deluge WebUI password, set it via PASS=")
+	flag.StringVar(&Daemon, "daemon", "", "Daemon host[:port] or host ID the WebUI should be connected to, it gets connected on startup and whenever it's found disconnected")
 	flag.StringVar(&LogFile, "logfile", "", "Send logs to a file")
+	flag.StringVar(&DataDir, "datadir", "", "Directory to keep the bot's data in, e.g. transfer counters, nothing is kept across restarts if empty")
+	flag.BoolVar(&Notify, "notify", false, "Notify about torrents that finish or run into errors")
+	flag.StringVar(&Config, "config", "", "JSON file with named Deluge backends, overrides -url, -password and -daemon")
+	flag.Int64Var(&ChatID, "chatid", 0, "Chat ID to send notifications to, defaults to the last chat the master talked to the bot in, set it via CHATID=")
+	digestAt := flag.String("digest", "", "Comma separated times to send a digest at as [weekday] HH:MM, e.g. 08:00 for every day or mon 08:00 for every week")
+	timezone := flag.String("timezone", "", "Timezone of the digest times, e.g. Europe/Berlin, defaults to the local one")
+	flag.DurationVar(&StallTime, "stalltime", StallTime, "How long a downloading torrent can go without progress before it's stalled")
+	flag.BoolVar(&StallAlerts, "stallalerts", false, "Alert about downloading torrents once they stall")
+	stallPolicy := flag.String("stallpolicy", "", "Comma separated rules for stalled torrents as action:time, e.g. reannounce:6h,pause:72h, actions are pause, remove and reannounce")
+	minFree := flag.String("minfree", "", "Alert once a save path has less free space than this, e.g. 10GB, no disk checks if empty")
+	flag.BoolVar(&LowSpacePause, "lowspacepause", false, "Pause downloading torrents while a save path is below -minfree, and resume them once it recovers")
+	pathMap := flag.String("pathmap", "", "Comma separated deluge-path=local-path prefixes, for when Deluge's paths differ on the bot's host, e.g. /downloads=/mnt/seedbox")
+	viewers := flag.String("viewers", "", "Comma separated telegram handlers that may use the commands that only list and show things, set it via VIEWERS=")
+	flag.StringVar(&AuditLog, "auditlog", "", "JSON lines file to log every action taken through the bot to, defaults to audit.jsonl in -datadir, no audit log if neither is set")
+	flag.StringVar(&MetricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics at /metrics and health checks at /healthz, e.g. :9090, neither if empty")
+	flag.StringVar(&StateDir, "statedir", "", "Deluge's state directory as Deluge sees it, for torrentfile, found through Deluge's config if empty")
+	uploadLimit := flag.String("uploadlimit", "50MB", "The biggest file the bot can upload to Telegram, raise it for a local Bot API server")
+	seedPolicy := flag.String("seedpolicy", "", "Comma separated seed time rules as action:time[:tracker], e.g. pause:48h:example.org,remove:72h, the rules changed through the bot are kept in -datadir and replace these")
+	moveDirs := flag.String("movedirs", "", "Comma separated list of directories that 'move' is allowed to move data into, any if empty")
 
 	// set the usage message
 	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, "Usage: TOKEN=<xxx> MASTER=<@tuser> PASS=<pass> deluge-telegram -url=[http://] [-logfile=file]\n\n")
+		fmt.Fprint(os.Stderr, "Usage: TOKEN=<xxx> MASTER=<@tuser> PASS=<pass> deluge-telegram -url=[http://] [-logfile=file] [-movedirs=dir,dir]\n")
+		fmt.Fprint(os.Stderr, "       PASS=<pass> deluge-telegram export [-url=http://] [-config=file] json|csv [query]\n\n")
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	// subcommands come before the flags and run without Telegram
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		Subcommand = os.Args[1]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	// if one of token, master, password isn't set, set it to the corrsponding environment variable.
 	if BotToken == "" {
@@ -154,10 +128,16 @@ func init() {
 	if Password == "" {
 		Password = os.Getenv("PASS")
 	}
+	if *viewers == "" {
+		*viewers = os.Getenv("VIEWERS")
+	}
+	if ChatID == 0 {
+		ChatID, _ = strconv.ParseInt(os.Getenv("CHATID"), 10, 64)
+	}
 
 	// make sure that we have the two madatory arguments: telegram token & master's handler.
-	if BotToken == "" ||
-		Master == "" {
+	if Subcommand == "" && (BotToken == "" ||
+		Master == "") {
 		fmt.Fprintf(os.Stderr, "Error: Mandatory argument missing! (-token or -master)\n\n")
 		flag.Usage()
 		os.Exit(1)
@@ -165,58 +145,141 @@ func init() {
 
 	// make sure that the handler doesn't contain @
 	Master = strings.Replace(Master, "@", "", -1)
+	for _, viewer := range strings.Split(*viewers, ",") {
+		if viewer = strings.TrimSpace(strings.Replace(viewer, "@", "", -1)); viewer != "" {
+			Viewers = append(Viewers, viewer)
+		}
+	}
 
-	// if we got a log file, log to it
-	if LogFile != "" {
-		logf, err := os.OpenFile(LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	// parse the seed time rules
+	for _, r := range strings.Split(*seedPolicy, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+
+		rule, err := parseSeedRule(r)
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintf(os.Stderr, "Error: -seedpolicy: %s\n\n", err)
+			flag.Usage()
+			os.Exit(1)
 		}
-		log.SetOutput(logf)
+		seedRules = append(seedRules, rule)
 	}
-	// log the flags
-	log.Printf("[INFO] Settings:\n\tToken = %s\n\tMaster = %s\n\tURL = %s\n\tPASS = %s",
-		BotToken, Master, DelugeURL, Password)
-}
 
-// init deluge
-func init() {
 	var err error
-	Client, err = deluge.New(DelugeURL+"/json", Password)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERROR] Deluge: %s\n", err)
+	if *minFree != "" {
+		if MinFree, err = humanize.ParseBytes(*minFree); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -minfree: %s\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if PathMap, err = parsePathMap(*pathMap); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -pathmap: %s\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if UploadLimit, err = humanize.ParseBytes(*uploadLimit); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -uploadlimit: %s\n\n", err)
+		flag.Usage()
 		os.Exit(1)
 	}
-}
 
-// init Telegram
-func init() {
-	var err error
-	Bot, err = tgbotapi.NewBotAPI(BotToken)
+	// parse the stall rules
+	for _, r := range strings.Split(*stallPolicy, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERROR] Telegram: %s\n", err)
+		rule, err := parseStallRule(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -stallpolicy: %s\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		stallRules = append(stallRules, rule)
+	}
+
+	// parse the digest schedule
+	if digestTimes, err = parseDigestTimes(*digestAt); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -digest: %s\n\n", err)
+		flag.Usage()
 		os.Exit(1)
 	}
-	log.Printf("[INFO] Authorized: %s", Bot.Self.UserName)
+	if *timezone != "" {
+		if digestLocation, err = time.LoadLocation(*timezone); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -timezone: %s\n\n", err)
+			os.Exit(1)
+		}
+	}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	// the backends come from the config file, or the flags if there's none
+	if Config != "" {
+		if Backends, err = loadBackends(Config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -config: %s\n\n", err)
+			os.Exit(1)
+		}
+	} else {
+		Backends = []*Backend{{Name: "deluge", URL: DelugeURL, Password: Password, Daemon: Daemon}}
+	}
 
-	Updates, err = Bot.GetUpdatesChan(u)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[ERROR] Telegram: %s\n", err)
-		os.Exit(1)
+	if DataDir != "" {
+		if err := os.MkdirAll(DataDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -datadir: %s\n\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// clean the allowed move directories up, so they compare with cleaned destinations
+	for _, dir := range strings.Split(*moveDirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			MoveDirs = append(MoveDirs, path.Clean(dir))
+		}
+	}
+
+	// if we got a log file, log to it
+	if LogFile != "" {
+		logf, err := os.OpenFile(LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(logf)
+	}
+	if Subcommand != "" {
+		return
+	}
+
+	// log the flags
+	log.Printf("[INFO] Settings:\n\tToken = %s\n\tMaster = %s\n\tMoveDirs = %s",
+		BotToken, Master, strings.Join(MoveDirs, ", "))
+	for _, b := range Backends {
+		log.Printf("[INFO] Backend %s:\n\tURL = %s\n\tPASS = %s\n\tDaemon = %s", b.Name, b.URL, b.Password, b.Daemon)
 	}
 }
 
+// View is a named Deluge instance along with its torrents, each instance has
+// its own view so an ID never refers to a torrent on another instance.
 type View struct {
+	Name     string
+	URL      string
+	Client   *deluge.Deluge
 	Torrents deluge.Torrents
 	Sort     deluge.Sorting
+
+	subs   eventSubs
+	daemon string // the daemon its Web UI gets connected to, if any
+	ready  int32  // 1 once its Web UI has been reached
 }
 
-func (v *View) Update() (err error) {
-	v.Torrents, err = Client.GetTorrents()
+// Update fetches the torrents with the given fields, or all of their fields if none are given.
+func (v *View) Update(fields ...string) (err error) {
+	// the sorting needs its field as well
+	if fields != nil {
+		fields = append(fields, v.Sort.Field())
+	}
+
+	v.Torrents, err = v.Client.GetTorrents(fields...)
 	if err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		return err
@@ -264,10 +327,12 @@ func (v *View) Update() (err error) {
 	return
 }
 
+// GetTorrentByID returns the torrent with the given ID as of the last Update, which only has the
+// fields that Update got besides its ID, hash and name; get the others with Client.GetTorrent.
 func (v *View) GetTorrentByID(id int) (*deluge.Torrent, error) {
 	// if there's no view, get one
-	if view.Torrents == nil {
-		if err := view.Update(); err != nil {
+	if v.Torrents == nil {
+		if err := v.Update(); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
 			return nil, err
 		}
@@ -281,113 +346,135 @@ func (v *View) GetTorrentByID(id int) (*deluge.Torrent, error) {
 	return nil, fmt.Errorf("Can't find a torrent with ID: %d", id)
 }
 
-func main() {
-	for update := range Updates {
-		// ignore edited messages
-		if update.Message == nil {
-			continue
+// Select takes a selector and returns the torrents it matches, a selector is
+// 'all', an ID, a range of IDs (e.g. 3-7) or a comma separated list of those.
+// like GetTorrentByID, the torrents may have only their ID, hash and name.
+func (v *View) Select(selector string) (deluge.Torrents, error) {
+	if selector == "all" {
+		if err := v.Update(); err != nil {
+			return nil, err
 		}
+		return v.Torrents, nil
+	}
 
-		// ignore anyone other than 'master'
-		if strings.ToLower(update.Message.From.UserName) != strings.ToLower(Master) {
-			log.Printf("[INFO] Ignored a message from: %s", update.Message.From.String())
+	// the ranges of IDs, a single ID is a range that starts and ends with itself
+	var ranges [][2]int
+	for _, part := range strings.Split(selector, ",") {
+		if part == "" {
 			continue
 		}
 
-		// tokenize the update
-		tokens := strings.Split(update.Message.Text, " ")
-		command := strings.ToLower(tokens[0])
-
-		switch command {
-		case "update", "/update", "ud", "/ud":
-			view.Update()
-
-		case "list", "/list", "li", "/li":
-			go list(update, tokens[1:])
-
-		case "head", "/head", "he", "/he":
-			go head(update, tokens[1:])
-
-		case "tail", "/tail", "ta", "/ta":
-			go tail(update, tokens[1:])
-
-		case "downs", "/downs", "dl", "/dl":
-			go downs(update)
-
-		case "seeding", "/seeding", "sd", "/sd":
-			go seeding(update)
-
-		case "paused", "/paused", "pa", "/pa":
-			go paused(update)
-
-		case "checking", "/checking", "ch", "/ch":
-			go checking(update)
-
-		case "active", "/active", "ac", "/ac":
-			go active(update)
-
-		case "errors", "/errors", "er", "/er":
-			go errors(update)
-
-		case "sort", "/sort", "so", "/so":
-			go sort(update, tokens[1:])
-
-		case "add", "/add", "ad", "/ad":
-			go add(update, tokens[1:])
-
-		case "search", "/search", "se", "/se":
-			go search(update, tokens[1:])
-
-		case "latest", "/latest", "la", "/la":
-			go latest(update, tokens[1:])
+		from, to := part, part
+		if i := strings.Index(part, "-"); i > 0 {
+			from, to = part[:i], part[i+1:]
+		}
 
-		case "info", "/info", "in", "/in":
-			go info(update, tokens[1:])
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid selector", part)
+		}
+		last, err := strconv.Atoi(to)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("%s is not a valid selector", part)
+		}
+		ranges = append(ranges, [2]int{first, last})
+	}
 
-		case "stop", "/stop", "sp", "/sp":
-			go stop(update, tokens[1:])
+	// if there's no view, get one
+	if v.Torrents == nil {
+		if err := v.Update(); err != nil {
+			return nil, err
+		}
+	}
 
-		case "start", "/start", "st", "/st":
-			go start(update, tokens[1:])
+	// IDs that don't exist are skipped, so a range doesn't fail over a torrent that got removed
+	var torrents deluge.Torrents
+	for _, torrent := range v.Torrents {
+		for _, r := range ranges {
+			if torrent.ID >= r[0] && torrent.ID <= r[1] {
+				torrents = append(torrents, torrent)
+				break
+			}
+		}
+	}
 
-		case "check", "/check", "ck", "/ck":
-			go check(update, tokens[1:])
+	if len(torrents) == 0 {
+		return nil, fmt.Errorf("%s matches no torrents", selector)
+	}
+	return torrents, nil
+}
 
-		case "speed", "/speed", "ss", "/ss":
-			go speed(update)
+func main() {
+	parseFlags()
+	setupBackends()
 
-		case "count", "/count", "co", "/co":
-			go count(update)
+	if Subcommand == "export" {
+		os.Exit(exportCLI(flag.Args()))
+	}
 
-		case "del", "/del":
-			go del(update, tokens[1:])
+	go handleSignals()
+	if !connectTelegram() {
+		return
+	}
 
-		case "deldata", "/deldata":
-			go deldata(update, tokens[1:])
+	go setCommands()
 
-		case "help", "/help":
-			go send(HELP, update.Message.Chat.ID, true)
+	// the backends that are down get connected once they're up, Telegram works meanwhile
+	for _, v := range views {
+		if err := v.connect(); err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			go v.reconnect()
+		}
+	}
 
-		case "version", "/version":
-			go version(update)
+	for _, v := range views {
+		go v.dispatchEvents()
+		if Notify {
+			go notifyEvents(v)
+		}
+	}
+	background(seedPolicy)
+	background(trackTransfers)
+	background(recordSpeedHistory)
+	background(digestLoop)
+	background(trackStalled)
+	background(watchDisk)
+	go serveMetrics()
+	go startupReport()
 
-		case "":
-			// might be a file received
-			go receiveTorrent(update)
+	for {
+		var update tgbotapi.Update
+		select {
+		case update = <-Updates:
+		case <-shutdown:
+			stopBot()
+			return
+		}
 
-		default:
-			// no such command, try help
-			go send("no such command, try /help", update.Message.Chat.ID, false)
+		// presses of the inline buttons
+		if cq := update.CallbackQuery; cq != nil {
+			if strings.ToLower(cq.From.UserName) != strings.ToLower(Master) {
+				log.Printf("[INFO] Ignored a button press from: %s", cq.From.String())
+				continue
+			}
+			go pressButton(cq)
+			continue
+		}
 
+		// ignore edited messages
+		if update.Message == nil {
+			continue
 		}
+
+		dispatch(update)
 	}
 }
 
 // list will form and send a list of all the torrents
 // takes an optional argument which is a query to match against trackers
 // to list only torrents that has a tracker that matchs.
-func list(ud tgbotapi.Update, tokens []string) {
-	if err := view.Update(); err != nil {
+func list(view *View, ud tgbotapi.Update, tokens []string) {
+	if err := view.Update(listFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("list: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -429,8 +516,8 @@ func list(ud tgbotapi.Update, tokens []string) {
 }
 
 // head will list the first 5 or n torrents
-func head(ud tgbotapi.Update, tokens []string) {
-	if err := view.Update(); err != nil {
+func head(view *View, ud tgbotapi.Update, tokens []string) {
+	if err := view.Update(liveFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("list: %s"+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -468,14 +555,27 @@ func head(ud tgbotapi.Update, tokens []string) {
 
 	msgID := send(buf.String(), ud.Message.Chat.ID, true)
 
-	// keep updating the info for (duration * interval)
+	// keep updating the info for (duration * interval), or until the bot stops
+	if !hold(&liveMessages) {
+		return
+	}
+	defer liveMessages.Done()
+	events, unsubscribe := view.Subscribe()
+	defer unsubscribe()
 	for i := 0; i < duration; i++ {
-		time.Sleep(time.Second * interval)
+		// refresh every interval, or right away when something happens to a torrent
+		waitTorrentEvent(events, "", time.Second*interval)
+		if stopping() {
+			break
+		}
 
-		if err := view.Update(); err != nil {
+		if err := view.Update(liveFields...); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
 			continue // if there's an error, skip to the next intration
 		}
+		if n > len(view.Torrents) {
+			n = len(view.Torrents) // some got removed meanwhile
+		}
 
 		buf.Reset()
 		for _, torrent := range view.Torrents[:n] {
@@ -503,8 +603,8 @@ func head(ud tgbotapi.Update, tokens []string) {
 }
 
 // tail will list the first 5 or n torrents
-func tail(ud tgbotapi.Update, tokens []string) {
-	if err := view.Update(); err != nil {
+func tail(view *View, ud tgbotapi.Update, tokens []string) {
+	if err := view.Update(liveFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("list: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -542,14 +642,27 @@ func tail(ud tgbotapi.Update, tokens []string) {
 
 	msgID := send(buf.String(), ud.Message.Chat.ID, true)
 
-	// keep updating the info for (duration * interval)
+	// keep updating the info for (duration * interval), or until the bot stops
+	if !hold(&liveMessages) {
+		return
+	}
+	defer liveMessages.Done()
+	events, unsubscribe := view.Subscribe()
+	defer unsubscribe()
 	for i := 0; i < duration; i++ {
-		time.Sleep(time.Second * interval)
+		// refresh every interval, or right away when something happens to a torrent
+		waitTorrentEvent(events, "", time.Second*interval)
+		if stopping() {
+			break
+		}
 
-		if err := view.Update(); err != nil {
+		if err := view.Update(liveFields...); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
 			continue // if there's an error, skip to the next intration
 		}
+		if n > len(view.Torrents) {
+			n = len(view.Torrents) // some got removed meanwhile
+		}
 
 		buf.Reset()
 		for _, torrent := range view.Torrents[len(view.Torrents)-n:] {
@@ -577,8 +690,8 @@ func tail(ud tgbotapi.Update, tokens []string) {
 }
 
 // downs will send the names of torrents with status 'Downloading' or in queue to
-func downs(ud tgbotapi.Update) {
-	if err := view.Update(); err != nil {
+func downs(view *View, ud tgbotapi.Update) {
+	if err := view.Update(stateFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("list: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -599,8 +712,8 @@ func downs(ud tgbotapi.Update) {
 }
 
 // seeding will send the names of the torrents with the status 'Seeding'
-func seeding(ud tgbotapi.Update) {
-	if err := view.Update(); err != nil {
+func seeding(view *View, ud tgbotapi.Update) {
+	if err := view.Update(stateFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("seeding: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -623,8 +736,8 @@ func seeding(ud tgbotapi.Update) {
 }
 
 // paused will send the names of the torrents with the status 'Seeding'
-func paused(ud tgbotapi.Update) {
-	if err := view.Update(); err != nil {
+func paused(view *View, ud tgbotapi.Update) {
+	if err := view.Update(stateFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("paused: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -647,8 +760,8 @@ func paused(ud tgbotapi.Update) {
 }
 
 // checking will send the names of the torrents with the status 'Seeding'
-func checking(ud tgbotapi.Update) {
-	if err := view.Update(); err != nil {
+func checking(view *View, ud tgbotapi.Update) {
+	if err := view.Update(stateFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("checking: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -671,8 +784,8 @@ func checking(ud tgbotapi.Update) {
 }
 
 // active will send the names of the torrents with the status 'Seeding'
-func active(ud tgbotapi.Update) {
-	if err := view.Update(); err != nil {
+func active(view *View, ud tgbotapi.Update) {
+	if err := view.Update(liveFields...); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("active: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -695,11 +808,21 @@ func active(ud tgbotapi.Update) {
 
 	msgID := send(buf.String(), ud.Message.Chat.ID, true)
 
-	// keep updating the info for (duration * interval)
+	// keep updating the info for (duration * interval), or until the bot stops
+	if !hold(&liveMessages) {
+		return
+	}
+	defer liveMessages.Done()
+	events, unsubscribe := view.Subscribe()
+	defer unsubscribe()
 	for i := 0; i < duration; i++ {
-		time.Sleep(time.Second * interval)
+		// refresh every interval, or right away when something happens to a torrent
+		waitTorrentEvent(events, "", time.Second*interval)
+		if stopping() {
+			break
+		}
 
-		if err := view.Update(); err != nil {
+		if err := view.Update(liveFields...); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
 			continue // if there's an error, skip to the next intration
 		}
@@ -735,32 +858,132 @@ func active(ud tgbotapi.Update) {
 	Bot.Send(editConf)
 }
 
-// errors will send the names of the torrents with the status 'Seeding'
-func errors(ud tgbotapi.Update) {
-	if err := view.Update(); err != nil {
+// errors sends the torrents in the Error state, the ones with missing files, and the ones whose
+// trackers fail grouped by tracker and message, each group with buttons to fix it.
+func errors(view *View, ud tgbotapi.Update) {
+	if err := view.Update("name", "state", "message", "tracker_host", "tracker_status"); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("errors: "+err.Error(), ud.Message.Chat.ID, false)
 		return
 	}
 
-	buf := new(bytes.Buffer)
+	var (
+		failed, missing deluge.Torrents
+		trackers        = make(map[string]deluge.Torrents) // by tracker and message
+		trackerOrder    []string
+	)
 	for _, torrent := range view.Torrents {
-		if !strings.Contains(torrent.TrackerStatus, "Announce OK") {
-			buf.WriteString(fmt.Sprintf("<%d> %s\n%s\n", torrent.ID, torrent.Name, torrent.TrackerStatus))
+		switch {
+		case torrent.State == "Error" && missingFiles(torrent.Message):
+			missing = append(missing, torrent)
+		case torrent.State == "Error":
+			failed = append(failed, torrent)
+		// a paused torrent's tracker status is left over from its last announce
+		case torrent.State != "Paused" && strings.Contains(torrent.TrackerStatus, "Error"):
+			key := torrent.TrackerHost + "\n" + torrent.TrackerStatus
+			if _, ok := trackers[key]; !ok {
+				trackerOrder = append(trackerOrder, key)
+			}
+			trackers[key] = append(trackers[key], torrent)
 		}
 	}
 
-	if buf.Len() == 0 {
+	if len(failed)+len(missing)+len(trackers) == 0 {
 		send("No errors", ud.Message.Chat.ID, false)
 		return
 	}
 
-	send(buf.String(), ud.Message.Chat.ID, false)
+	chatID := ud.Message.Chat.ID
+	if len(failed) > 0 {
+		sendErrorGroup(view, chatID, "Error", failed, true, "resume", "recheck")
+	}
+	if len(missing) > 0 {
+		sendErrorGroup(view, chatID, "Missing files", missing, true, "recheck")
+	}
+	for _, key := range trackerOrder {
+		sendErrorGroup(view, chatID, "Tracker: "+key, trackers[key], false, "reannounce")
+	}
+}
+
+// missingFiles tells if a torrent's error message is about its data being gone
+func missingFiles(message string) bool {
+	message = strings.ToLower(message)
+	for _, s := range []string{"no such file", "missing", "cannot find", "not found"} {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorGroupLimit is how many torrents an error group lists, its buttons still fix all of them
+var errorGroupLimit = 30
+
+// errorGroupMaxLen keeps an error group within a single message, the buttons only go with one
+const errorGroupMaxLen = 3500
+
+// sendErrorGroup sends a group of torrents with the same error, along with a button for each fix
+// that applies it to all of them; withMessage lists each torrent's own message.
+func sendErrorGroup(view *View, chatID int64, title string, torrents deluge.Torrents, withMessage bool, fixes ...string) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(fmt.Sprintf("%s (%d)\n", title, len(torrents)))
+	for i, torrent := range torrents {
+		if i == errorGroupLimit || buf.Len() > errorGroupMaxLen {
+			buf.WriteString(fmt.Sprintf("and %d more\n", len(torrents)-i))
+			break
+		}
+		buf.WriteString(fmt.Sprintf("<%d> %s\n", torrent.ID, torrent.Name))
+		if withMessage && torrent.Message != "" {
+			buf.WriteString(torrent.Message + "\n")
+		}
+	}
+
+	hashes := make([]string, len(torrents))
+	for i, torrent := range torrents {
+		hashes[i] = torrent.Hash
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+	for _, fix := range fixes {
+		fix := fix
+		label := fmt.Sprintf("%s%s %d", strings.ToUpper(fix[:1]), fix[1:], len(hashes))
+		row = append(row, newAuditedButton(label, view, fmt.Sprintf("errors: %s %s", fix, title), torrents,
+			func(cq *tgbotapi.CallbackQuery) string {
+				return fixTorrents(view, fix, hashes)
+			}))
+	}
+
+	sendButtons(buf.String(), chatID, false, row)
+}
+
+// fixTorrents resumes, rechecks or reannounces the torrents, returns how it went
+func fixTorrents(view *View, fix string, hashes []string) string {
+	var fixed int
+	for _, hash := range hashes {
+		var err error
+		switch fix {
+		case "resume":
+			err = view.Client.StartTorrent(hash)
+		case "recheck":
+			err = view.Client.CheckTorrent(hash)
+		case "reannounce":
+			err = view.Client.ForceReannounce(hash)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			continue
+		}
+		fixed++
+	}
 
+	if fixed < len(hashes) {
+		return fmt.Sprintf("%s: %d of %d torrents, check the logs", fix, fixed, len(hashes))
+	}
+	return fmt.Sprintf("%s: %d torrents", fix, fixed)
 }
 
 // sort changes torrents sorting
-func sort(ud tgbotapi.Update, tokens []string) {
+func sort(view *View, ud tgbotapi.Update, tokens []string) {
 	if len(tokens) == 0 {
 		send(`sort takes one of:
 			(*name, age, size, progress, downspeed, upspeed, download, upload, ratio*)
@@ -843,62 +1066,24 @@ func sort(ud tgbotapi.Update, tokens []string) {
 }
 
 // add takes an URL to a .torrent file to add
-func add(ud tgbotapi.Update, tokens []string) {
+func add(view *View, ud tgbotapi.Update, tokens []string) {
 	if len(tokens) == 0 {
-		send("add: needs atleast one URL", ud.Message.Chat.ID, false)
+		reply(ud, "add: needs atleast one URL", false)
 		return
 	}
 
-	var hash string
-	var err error
-	// loop over the URL/s and add them
+	// loop over the URL/s and add them, unless they're already there
 	for _, url := range tokens {
 		if strings.HasPrefix(url, "magnet") {
-			hash, err = Client.AddTorrentMagnet(url)
+			addMagnet(view, recorderOf(ud), ud.Message.Chat.ID, url)
 		} else { // not a magnet
-			hash, err = Client.AddTorrentUrl(url)
-		}
-
-		if err != nil {
-			log.Printf("[ERROR] Deluge: %s", err)
-			send(err.Error(), ud.Message.Chat.ID, false)
-			continue
-		}
-
-		torrent, err := Client.GetTorrent(hash)
-
-		if err != nil {
-			log.Printf("[ERROR] Deluge: %s", err)
-			send("add: "+err.Error(), ud.Message.Chat.ID, false)
-			continue
+			addURL(view, recorderOf(ud), ud.Message.Chat.ID, url)
 		}
-
-		send(fmt.Sprintf("Added: %s", torrent.Name), ud.Message.Chat.ID, false)
-	}
-}
-
-// receiveTorrent gets an update that potentially has a .torrent file to add
-func receiveTorrent(ud tgbotapi.Update) {
-	if ud.Message.Document.FileID == "" {
-		return // has no document
-	}
-
-	// get the file ID and make the config
-	fconfig := tgbotapi.FileConfig{
-		FileID: ud.Message.Document.FileID,
-	}
-	file, err := Bot.GetFile(fconfig)
-	if err != nil {
-		send("receiver: "+err.Error(), ud.Message.Chat.ID, false)
-		return
 	}
-
-	// add by file URL
-	add(ud, []string{file.Link(BotToken)})
 }
 
 // search takes a query and returns torrents with match
-func search(ud tgbotapi.Update, tokens []string) {
+func search(view *View, ud tgbotapi.Update, tokens []string) {
 	// make sure that we got a query
 	if len(tokens) == 0 {
 		send("search: needs an argument", ud.Message.Chat.ID, false)
@@ -913,7 +1098,7 @@ func search(ud tgbotapi.Update, tokens []string) {
 		return
 	}
 
-	if err := view.Update(); err != nil {
+	if err := view.Update("name"); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("search: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -933,7 +1118,7 @@ func search(ud tgbotapi.Update, tokens []string) {
 }
 
 // latest takes n and returns the latest n torrents
-func latest(ud tgbotapi.Update, tokens []string) {
+func latest(view *View, ud tgbotapi.Update, tokens []string) {
 	var (
 		n   = 5 // default to 5
 		err error
@@ -947,7 +1132,7 @@ func latest(ud tgbotapi.Update, tokens []string) {
 		}
 	}
 
-	if err := view.Update(); err != nil {
+	if err := view.Update("name", "time_added"); err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("latest: "+err.Error(), ud.Message.Chat.ID, false)
 		return
@@ -972,7 +1157,7 @@ func latest(ud tgbotapi.Update, tokens []string) {
 }
 
 // info takes an id of a torrent and returns some info about it
-func info(ud tgbotapi.Update, tokens []string) {
+func info(view *View, ud tgbotapi.Update, tokens []string) {
 	if len(tokens) == 0 {
 		send("info: needs a torrent ID number", ud.Message.Chat.ID, false)
 		return
@@ -992,7 +1177,7 @@ func info(ud tgbotapi.Update, tokens []string) {
 		}
 
 		// get an updated view of that torrent
-		torrent, err = Client.GetTorrent(torrent.Hash)
+		torrent, err = view.Client.GetTorrent(torrent.Hash, infoFields...)
 		if err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
 			send("info: Deluge error while getting: "+torrent.Name, ud.Message.Chat.ID, false)
@@ -1012,11 +1197,29 @@ func info(ud tgbotapi.Update, tokens []string) {
 
 		// this go-routine will make the info live for 'duration * interval'
 		// takes torrent name so we don't have to use mdReplacer
+		if !hold(&liveMessages) {
+			continue
+		}
 		go func(torrentName string, torrentID, msgID int) {
+			defer liveMessages.Done()
+			events, unsubscribe := view.Subscribe()
+			defer unsubscribe()
+
 			for i := 0; i < duration; i++ {
-				time.Sleep(time.Second * interval)
+				// refresh every interval, or right away when something happens to the torrent
+				event := waitTorrentEvent(events, torrent.Hash, time.Second*interval)
+				if stopping() {
+					break
+				}
+				if _, ok := event.(deluge.TorrentRemovedEvent); ok {
+					editConf := tgbotapi.NewEditMessageText(ud.Message.Chat.ID, msgID,
+						fmt.Sprintf("`<%d>` *%s*\nRemoved", torrentID, torrentName))
+					editConf.ParseMode = tgbotapi.ModeMarkdown
+					Bot.Send(editConf)
+					return
+				}
 
-				torrent, err = Client.GetTorrent(torrent.Hash)
+				torrent, err = view.Client.GetTorrent(torrent.Hash, infoFields...)
 				if err != nil {
 					log.Printf("[ERROR] Deluge: %s", err)
 					continue // skip this iteration if there's an error retrieving the torrent's info
@@ -1049,62 +1252,62 @@ func info(ud tgbotapi.Update, tokens []string) {
 }
 
 // stop takes id[s] of torrent[s] or 'all' to stop them
-func stop(ud tgbotapi.Update, tokens []string) {
+func stop(view *View, ud tgbotapi.Update, tokens []string) {
 	// make sure that we got at least one argument
 	if len(tokens) == 0 {
-		send("stop: needs an argument", ud.Message.Chat.ID, false)
+		reply(ud, "stop: needs an argument", false)
 		return
 	}
 
 	// if the first argument is 'all' then stop all torrents
 	if tokens[0] == "all" {
-		if err := Client.PauseAll(); err != nil {
-			send("stop: error occurred while stopping torrents", ud.Message.Chat.ID, false)
+		if err := view.Client.PauseAll(); err != nil {
+			reply(ud, "stop: error occurred while stopping torrents", false)
 			return
 		}
-		send("stopped all torrents", ud.Message.Chat.ID, false)
+		reply(ud, "stopped all torrents", false)
 		return
 	}
 
 	for _, id := range tokens {
 		num, err := strconv.Atoi(id)
 		if err != nil {
-			send(fmt.Sprintf("stop: %s is not a number", id), ud.Message.Chat.ID, false)
+			reply(ud, fmt.Sprintf("stop: %s is not a number", id), false)
 			continue
 		}
 
 		torrent, err := view.GetTorrentByID(num)
 		if err != nil {
-			send("stop: "+err.Error(), ud.Message.Chat.ID, false)
+			reply(ud, "stop: "+err.Error(), false)
 			continue
 		}
 
-		if err := Client.PauseTorrent(torrent.Hash); err != nil {
+		if err := view.Client.PauseTorrent(torrent.Hash); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
-			send("stop: an error occurred while stopping: "+torrent.Name, ud.Message.Chat.ID, false)
+			reply(ud, "stop: an error occurred while stopping: "+torrent.Name, false)
 			continue
 		}
 
-		send(fmt.Sprintf("Stopped: %s", torrent.Name), ud.Message.Chat.ID, false)
+		reply(ud, fmt.Sprintf("Stopped: %s", torrent.Name), false)
 	}
 }
 
 // start takes id[s] of torrent[s] or 'all' to start them
-func start(ud tgbotapi.Update, tokens []string) {
+func start(view *View, ud tgbotapi.Update, tokens []string) {
 	// make sure that we got at least one argument
 	if len(tokens) == 0 {
-		send("start: needs an argument", ud.Message.Chat.ID, false)
+		reply(ud, "start: needs an argument", false)
 		return
 	}
 
 	// if the first argument is 'all' then start all torrents
 	if tokens[0] == "all" {
-		if err := Client.StartAll(); err != nil {
+		if err := view.Client.StartAll(); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
-			send("start: error occurred while starting some torrents", ud.Message.Chat.ID, false)
+			reply(ud, "start: error occurred while starting some torrents", false)
 			return
 		}
-		send("started all torrents", ud.Message.Chat.ID, false)
+		reply(ud, "started all torrents", false)
 		return
 
 	}
@@ -1112,96 +1315,959 @@ func start(ud tgbotapi.Update, tokens []string) {
 	for _, id := range tokens {
 		num, err := strconv.Atoi(id)
 		if err != nil {
-			send(fmt.Sprintf("start: %s is not a number", id), ud.Message.Chat.ID, false)
+			reply(ud, fmt.Sprintf("start: %s is not a number", id), false)
 			continue
 		}
 
 		torrent, err := view.GetTorrentByID(num)
 		if err != nil {
-			send("start: "+err.Error(), ud.Message.Chat.ID, false)
+			reply(ud, "start: "+err.Error(), false)
 			continue
 		}
 
-		if err := Client.StartTorrent(torrent.Hash); err != nil {
-			send("stop: "+err.Error(), ud.Message.Chat.ID, false)
+		if err := view.Client.StartTorrent(torrent.Hash); err != nil {
+			reply(ud, "stop: "+err.Error(), false)
 			continue
 		}
 
-		send(fmt.Sprintf("Started: %s", torrent.Name), ud.Message.Chat.ID, false)
+		reply(ud, fmt.Sprintf("Started: %s", torrent.Name), false)
 	}
 }
 
 // check takes id[s] of torrent[s] to verify them
-func check(ud tgbotapi.Update, tokens []string) {
+func check(view *View, ud tgbotapi.Update, tokens []string) {
 	// make sure that we got at least one argument
 	if len(tokens) == 0 {
-		send("check: needs an argument", ud.Message.Chat.ID, false)
+		reply(ud, "check: needs an argument", false)
 		return
 	}
 
 	for _, id := range tokens {
 		num, err := strconv.Atoi(id)
 		if err != nil {
-			send(fmt.Sprintf("check: %s is not a number", id), ud.Message.Chat.ID, false)
+			reply(ud, fmt.Sprintf("check: %s is not a number", id), false)
 			continue
 		}
 
 		torrent, err := view.GetTorrentByID(num)
 		if err != nil {
-			send("check: "+err.Error(), ud.Message.Chat.ID, false)
+			reply(ud, "check: "+err.Error(), false)
 			continue
 		}
 
-		if err := Client.CheckTorrent(torrent.Hash); err != nil {
+		if err := view.Client.CheckTorrent(torrent.Hash); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
-			send("check: ", ud.Message.Chat.ID, false)
+			reply(ud, "check: ", false)
 			continue
 		}
 
-		send(fmt.Sprintf("Verifying: %s", torrent.Name), ud.Message.Chat.ID, false)
+		reply(ud, fmt.Sprintf("Verifying: %s", torrent.Name), false)
 	}
 
 }
 
-// speed will echo back the current download and upload speeds
-func speed(ud tgbotapi.Update) {
-	// keep track of the returned message ID from 'send()' to edit the message.
-	var msgID int
-	for i := 0; i < duration; i++ {
-		download, upload, err := Client.SpeedRate()
-		if err != nil {
-			log.Printf("[ERROR] Deluge: %s", err)
-			continue
-		}
-
-		msg := fmt.Sprintf("↓ *%s*  ↑ *%s*", humanize.Bytes(uint64(download)), humanize.Bytes(uint64(upload)))
-
-		// if we haven't send a message, send it and save the message ID to edit it the next iteration
-		if msgID == 0 {
-			msgID = send(msg, ud.Message.Chat.ID, true)
-			time.Sleep(time.Second * interval)
-			continue
-		}
+// trackers takes an ID of a torrent and lists its trackers
+func trackers(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		send("trackers: needs a torrent ID number", ud.Message.Chat.ID, false)
+		return
+	}
 
-		// we have sent the message, let's update.
-		editConf := tgbotapi.NewEditMessageText(ud.Message.Chat.ID, msgID, msg)
-		editConf.ParseMode = tgbotapi.ModeMarkdown
-		Bot.Send(editConf)
-		time.Sleep(time.Second * interval)
+	num, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		send(fmt.Sprintf("trackers: %s is not a number", tokens[0]), ud.Message.Chat.ID, false)
+		return
 	}
 
-	// after the last iteration, show dashes to indicate that we are done updating.
-	editConf := tgbotapi.NewEditMessageText(ud.Message.Chat.ID, msgID, "↓ *- B*  ↑ *- B*")
-	editConf.ParseMode = tgbotapi.ModeMarkdown
-	Bot.Send(editConf)
-}
+	torrent, err := view.GetTorrentByID(num)
+	if err != nil {
+		send("trackers: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
 
-// count returns states with torrents count
-func count(ud tgbotapi.Update) {
-	state, trackers, err := Client.FilterTree()
+	// get an updated view of that torrent
+	torrent, err = view.Client.GetTorrent(torrent.Hash)
 	if err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
-		send("count: "+err.Error(), ud.Message.Chat.ID, false)
+		send("trackers: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(fmt.Sprintf("`<%d>` *%s*\n", num, mdReplacer.Replace(torrent.Name)))
+	for _, t := range torrent.Trackers {
+		buf.WriteString(fmt.Sprintf("Tier *%d*: `%s`\n", t.Tier, t.URL))
+	}
+	if len(torrent.Trackers) == 0 {
+		buf.WriteString("No trackers\n")
+	}
+	buf.WriteString(fmt.Sprintf("Status: %s", mdReplacer.Replace(torrent.TrackerStatus)))
+
+	send(buf.String(), ud.Message.Chat.ID, true)
+}
+
+// tracker takes an action (add, remove or replace), a selector and a tracker URL
+// to edit the trackers of the selected torrents. the selector can also be a tracker
+// host, which selects every torrent with a tracker on that host.
+func tracker(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) < 3 {
+		reply(ud, "tracker: needs an action (add, remove or replace), a selector and a URL", false)
+		return
+	}
+
+	action, selector, trackerURL := strings.ToLower(tokens[0]), tokens[1], tokens[2]
+	switch action {
+	case "add", "replace":
+		if u, err := url.Parse(trackerURL); err != nil || u.Host == "" ||
+			(u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") {
+			reply(ud, fmt.Sprintf("tracker: %s is not a tracker URL", trackerURL), false)
+			return
+		}
+	case "remove":
+	default:
+		reply(ud, fmt.Sprintf("tracker: unknown action %s, use add, remove or replace", tokens[0]), false)
+		return
+	}
+
+	torrents, host, err := selectByTracker(view, selector)
+	if err != nil {
+		reply(ud, "tracker: "+err.Error(), false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	for _, torrent := range torrents {
+		// get an updated view of that torrent to have its current trackers
+		updated, err := view.Client.GetTorrent(torrent.Hash)
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			buf.WriteString(fmt.Sprintf("Failed: %s (%s)\n", torrent.Name, err))
+			continue
+		}
+		torrent = updated
+
+		var trackers []*deluge.Tracker
+		switch action {
+		case "add":
+			trackers = addTracker(torrent.Trackers, trackerURL)
+		case "remove":
+			trackers = removeTracker(torrent.Trackers, trackerURL)
+		case "replace":
+			trackers = replaceTracker(torrent.Trackers, host, trackerURL)
+		}
+
+		if trackers == nil {
+			buf.WriteString(fmt.Sprintf("Unchanged: %s\n", torrent.Name))
+			continue
+		}
+
+		if err := view.Client.SetTrackers(torrent.Hash, trackers); err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			buf.WriteString(fmt.Sprintf("Failed: %s (%s)\n", torrent.Name, err))
+			continue
+		}
+
+		// announce to the new tracker right away
+		if action == "replace" {
+			if err := view.Client.ForceReannounce(torrent.Hash); err != nil {
+				log.Printf("[ERROR] Deluge: %s", err)
+			}
+		}
+
+		buf.WriteString(fmt.Sprintf("Updated: %s\n", torrent.Name))
+	}
+
+	reply(ud, buf.String(), false)
+}
+
+// selectByTracker takes a selector, if it isn't a selector of IDs it gets treated as
+// a tracker host, and returns the torrents that have a tracker on that host along with the host.
+func selectByTracker(view *View, selector string) (deluge.Torrents, string, error) {
+	torrents, err := view.Select(selector)
+	if err == nil {
+		return torrents, "", nil
+	}
+
+	// the host has to be one that Deluge knows about
+	_, hosts, ferr := view.Client.FilterTree()
+	if ferr != nil {
+		log.Printf("[ERROR] Deluge: %s", ferr)
+		return nil, "", ferr
+	}
+
+	var host string
+	for _, h := range hosts {
+		name := fmt.Sprintf("%v", h[0])
+		if name != "All" && name != "Error" && strings.EqualFold(name, selector) {
+			host = name
+			break
+		}
+	}
+	if host == "" {
+		return nil, "", err
+	}
+
+	if err := view.Update(); err != nil {
+		return nil, "", err
+	}
+
+	torrents = nil
+	for _, torrent := range view.Torrents {
+		if strings.EqualFold(torrent.TrackerHost, host) {
+			torrents = append(torrents, torrent)
+			continue
+		}
+		for _, t := range torrent.Trackers {
+			if trackerMatchesHost(t.URL, host) {
+				torrents = append(torrents, torrent)
+				break
+			}
+		}
+	}
+
+	if len(torrents) == 0 {
+		return nil, "", fmt.Errorf("no torrents on %s", host)
+	}
+	return torrents, host, nil
+}
+
+// selectByTrackerHost is selectByTracker without the host, it's tracker's Selects
+func selectByTrackerHost(view *View, selector string) (deluge.Torrents, error) {
+	torrents, _, err := selectByTracker(view, selector)
+	return torrents, err
+}
+
+// trackerMatchesHost reports whether the tracker's URL is on host or one of its subdomains,
+// which is how Deluge groups trackers under "tracker_host".
+func trackerMatchesHost(trackerURL, host string) bool {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return false
+	}
+
+	h, host := strings.ToLower(u.Hostname()), strings.ToLower(host)
+	return h == host || strings.HasSuffix(h, "."+host)
+}
+
+// addTracker returns trackers with trackerURL added in a new tier, or nil if it's already there.
+func addTracker(trackers []*deluge.Tracker, trackerURL string) []*deluge.Tracker {
+	tier := 0
+	for _, t := range trackers {
+		if t.URL == trackerURL {
+			return nil
+		}
+		if t.Tier >= tier {
+			tier = t.Tier + 1
+		}
+	}
+
+	return append(trackers, &deluge.Tracker{URL: trackerURL, Tier: tier})
+}
+
+// trackerHost returns the host of a tracker URL, or s itself if it's a bare host
+func trackerHost(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return s
+}
+
+// removeTracker returns trackers without the ones on the host of trackerURL, which can be
+// a bare host as well, or nil if none of them matches.
+func removeTracker(trackers []*deluge.Tracker, trackerURL string) []*deluge.Tracker {
+	host := trackerHost(trackerURL)
+
+	kept := make([]*deluge.Tracker, 0, len(trackers))
+	for _, t := range trackers {
+		if t.URL != trackerURL && !trackerMatchesHost(t.URL, host) {
+			kept = append(kept, t)
+		}
+	}
+
+	if len(kept) == len(trackers) {
+		return nil
+	}
+	return kept
+}
+
+// replaceTracker returns trackers with the ones on host replaced by trackerURL in the same tier,
+// if host is empty it's the host of trackerURL, so the other trackers are kept. returns nil if nothing changes.
+func replaceTracker(trackers []*deluge.Tracker, host, trackerURL string) []*deluge.Tracker {
+	if host == "" {
+		host = trackerHost(trackerURL)
+	}
+
+	var (
+		replaced []*deluge.Tracker
+		changed  bool
+		added    bool
+	)
+	for _, t := range trackers {
+		if !trackerMatchesHost(t.URL, host) {
+			// drop the old copy if the new URL was already there
+			if t.URL != trackerURL {
+				replaced = append(replaced, t)
+			}
+			continue
+		}
+
+		changed = changed || t.URL != trackerURL
+		if !added {
+			replaced = append(replaced, &deluge.Tracker{URL: trackerURL, Tier: t.Tier})
+			added = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return replaced
+}
+
+// reannounce takes a selector of torrents to force them to reannounce
+func reannounce(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		reply(ud, "reannounce: needs a selector", false)
+		return
+	}
+
+	torrents, err := view.Select(strings.Join(tokens, ","))
+	if err != nil {
+		reply(ud, "reannounce: "+err.Error(), false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	for _, torrent := range torrents {
+		if err := view.Client.ForceReannounce(torrent.Hash); err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			buf.WriteString(fmt.Sprintf("Failed: %s\n", torrent.Name))
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("Reannounced: %s\n", torrent.Name))
+	}
+
+	reply(ud, buf.String(), false)
+}
+
+// move takes a selector and a path to move the selected torrents' data to,
+// then reports each torrent once Deluge finishes moving it.
+func move(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) < 2 {
+		reply(ud, "move: needs a selector and a path", false)
+		return
+	}
+
+	// paths may have spaces in them
+	dest := path.Clean(strings.Join(tokens[1:], " "))
+	if err := allowedMoveDir(dest); err != nil {
+		reply(ud, "move: "+err.Error(), false)
+		return
+	}
+
+	torrents, err := view.Select(tokens[0])
+	if err != nil {
+		reply(ud, "move: "+err.Error(), false)
+		return
+	}
+
+	for _, torrent := range torrents {
+		// the view might not have the save paths
+		torrent, err := view.Client.GetTorrent(torrent.Hash, "name", "save_path")
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			reply(ud, "move: "+err.Error(), false)
+			continue
+		}
+
+		if path.Clean(torrent.SavePath) == dest {
+			reply(ud, fmt.Sprintf("move: %s is already in %s", torrent.Name, dest), false)
+			continue
+		}
+
+		if err := view.Client.MoveStorage(torrent.Hash, dest); err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			reply(ud, "move: an error occurred while moving: "+torrent.Name, false)
+			continue
+		}
+
+		reply(ud, fmt.Sprintf("Moving: %s", torrent.Name), false)
+
+		// its entry in the audit log waits for the move to be done
+		rec := recorderOf(ud)
+		rec.followUp()
+		go waitMove(view, rec, ud.Message.Chat.ID, torrent.Hash, torrent.Name, dest)
+	}
+}
+
+// allowedMoveDir returns an error if dest isn't an absolute path within one of MoveDirs
+func allowedMoveDir(dest string) error {
+	if !path.IsAbs(dest) {
+		return fmt.Errorf("%s is not an absolute path", dest)
+	}
+
+	if len(MoveDirs) == 0 {
+		return nil
+	}
+
+	for _, dir := range MoveDirs {
+		if dest == dir || strings.HasPrefix(dest, strings.TrimSuffix(dir, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not within the allowed directories: %s", dest, strings.Join(MoveDirs, ", "))
+}
+
+// waitMove watches a torrent until its save path becomes dest and it's no longer moving,
+// then tells the chat about it; it's a follow-up of rec, which gets the outcome.
+func waitMove(view *View, rec *auditRecorder, chatID int64, hash, name, dest string) {
+	defer rec.done()
+
+	events, unsubscribe := view.Subscribe()
+	defer unsubscribe()
+
+	for deadline := time.Now().Add(moveTimeout); time.Now().Before(deadline); {
+		// check whenever something happens to the torrent, and every now and then in case an event got missed
+		event := waitTorrentEvent(events, hash, 30*time.Second)
+		if stopping() {
+			rec.record(fmt.Sprintf("move: %s was still moving when the bot stopped", name))
+			return
+		}
+		if _, ok := event.(deluge.TorrentRemovedEvent); ok {
+			rec.send(fmt.Sprintf("%smove: %s got removed while moving", view.Label(), name), chatID, false)
+			return
+		}
+
+		torrent, err := view.Client.GetTorrent(hash)
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			continue
+		}
+
+		if torrent.State == "Error" {
+			rec.send(fmt.Sprintf("%smove: %s went into an error state while moving", view.Label(), name), chatID, false)
+			return
+		}
+
+		if path.Clean(torrent.SavePath) == dest && torrent.State != "Moving" {
+			rec.send(fmt.Sprintf("%sMoved: %s\nto: %s", view.Label(), name, dest), chatID, false)
+			return
+		}
+	}
+
+	rec.send(fmt.Sprintf("%smove: %s didn't finish moving in %s, check on it later", view.Label(), name, moveTimeout), chatID, false)
+}
+
+// rename takes an ID of a torrent and a new name for it, which renames its file
+// if it's a single file torrent, otherwise its top folder.
+func rename(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) < 2 {
+		reply(ud, "rename: needs a torrent ID and a new name", false)
+		return
+	}
+
+	num, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		reply(ud, fmt.Sprintf("rename: %s is not a number", tokens[0]), false)
+		return
+	}
+
+	newName := strings.Join(tokens[1:], " ")
+	if strings.Contains(newName, "/") || newName == "." || newName == ".." {
+		reply(ud, "rename: the new name can't be a path", false)
+		return
+	}
+
+	torrent, err := view.GetTorrentByID(num)
+	if err != nil {
+		reply(ud, "rename: "+err.Error(), false)
+		return
+	}
+
+	// get an updated view of that torrent to have its current files
+	torrent, err = view.Client.GetTorrent(torrent.Hash)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "rename: "+err.Error(), false)
+		return
+	}
+
+	if len(torrent.Files) == 0 {
+		reply(ud, "rename: "+torrent.Name+" has no files yet", false)
+		return
+	}
+
+	// a single file torrent has no folder to rename, so rename the file itself
+	if i := strings.Index(torrent.Files[0].Path, "/"); i == -1 {
+		err = view.Client.RenameFile(torrent.Hash, torrent.Files[0].Index, newName)
+	} else {
+		err = view.Client.RenameFolder(torrent.Hash, torrent.Files[0].Path[:i+1], newName+"/")
+	}
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "rename: "+err.Error(), false)
+		return
+	}
+
+	reply(ud, fmt.Sprintf("Renamed: %s\nto: %s", torrent.Name, newName), false)
+}
+
+// renamefile takes an ID of a torrent, an index of one of its files and a new path for that file,
+// with only an ID it lists the torrent's files along with their indexes.
+func renamefile(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		reply(ud, "renamefile: needs a torrent ID", false)
+		return
+	}
+
+	num, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		reply(ud, fmt.Sprintf("renamefile: %s is not a number", tokens[0]), false)
+		return
+	}
+
+	torrent, err := view.GetTorrentByID(num)
+	if err != nil {
+		reply(ud, "renamefile: "+err.Error(), false)
+		return
+	}
+
+	// get an updated view of that torrent to have its current files
+	torrent, err = view.Client.GetTorrent(torrent.Hash)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "renamefile: "+err.Error(), false)
+		return
+	}
+
+	if len(tokens) == 1 {
+		buf := new(bytes.Buffer)
+		for _, file := range torrent.Files {
+			buf.WriteString(fmt.Sprintf("<%d> %s (%s)\n", file.Index, file.Path, humanize.Bytes(uint64(file.Size))))
+		}
+		if buf.Len() == 0 {
+			reply(ud, "renamefile: "+torrent.Name+" has no files yet", false)
+			return
+		}
+		reply(ud, buf.String(), false)
+		return
+	}
+
+	if len(tokens) < 3 {
+		reply(ud, "renamefile: needs a file index and a new path", false)
+		return
+	}
+
+	index, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		reply(ud, fmt.Sprintf("renamefile: %s is not a number", tokens[1]), false)
+		return
+	}
+
+	var file *deluge.File
+	for _, f := range torrent.Files {
+		if f.Index == index {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		reply(ud, fmt.Sprintf("renamefile: %s has no file with index %d", torrent.Name, index), false)
+		return
+	}
+
+	// the new path must stay within the torrent's save path
+	newPath := path.Clean(strings.Join(tokens[2:], " "))
+	if path.IsAbs(newPath) || newPath == ".." || strings.HasPrefix(newPath, "../") {
+		reply(ud, "renamefile: the new path must be relative to the torrent", false)
+		return
+	}
+
+	if err := view.Client.RenameFile(torrent.Hash, file.Index, newPath); err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "renamefile: "+err.Error(), false)
+		return
+	}
+
+	reply(ud, fmt.Sprintf("Renamed: %s\nto: %s", file.Path, newPath), false)
+}
+
+// queueSettings maps the short names of the queue settings to Deluge's config keys
+var queueSettings = map[string]string{
+	"downloading": "max_active_downloading",
+	"seeding":     "max_active_seeding",
+	"limit":       "max_active_limit",
+}
+
+// queue lists the queued torrents in queue order, or shows and changes the queue settings
+func queue(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) > 0 {
+		switch strings.ToLower(tokens[0]) {
+		case "settings":
+			queueShowSettings(view, ud)
+		case "set":
+			queueSetSetting(view, ud, tokens[1:])
+		default:
+			reply(ud, "queue: takes no argument, settings or set", false)
+		}
+		return
+	}
+
+	if err := view.Update("name", "state", "queue"); err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "queue: "+err.Error(), false)
+		return
+	}
+
+	// finished torrents leave the queue with a position of -1
+	queued := make(deluge.Torrents, 0, len(view.Torrents))
+	for _, torrent := range view.Torrents {
+		if torrent.Queue >= 0 {
+			queued = append(queued, torrent)
+		}
+	}
+	queued.SortQueue(false)
+
+	buf := new(bytes.Buffer)
+	for _, torrent := range queued {
+		buf.WriteString(fmt.Sprintf("#%d <%d> %s (%s)\n", torrent.Queue+1, torrent.ID, torrent.Name, torrent.State))
+	}
+
+	if buf.Len() == 0 {
+		reply(ud, "queue: No queued torrents", false)
+		return
+	}
+	reply(ud, buf.String(), false)
+}
+
+// queueShowSettings sends the current queue settings
+func queueShowSettings(view *View, ud tgbotapi.Update) {
+	values, err := view.Client.ConfigValues("max_active_downloading", "max_active_seeding", "max_active_limit")
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "queue: "+err.Error(), false)
+		return
+	}
+
+	send(fmt.Sprintf("Downloading: *%v*\nSeeding: *%v*\nLimit: *%v*",
+		values["max_active_downloading"], values["max_active_seeding"], values["max_active_limit"]),
+		ud.Message.Chat.ID, true)
+}
+
+// queueSetSetting takes a queue setting and a number to set it to, -1 means unlimited
+func queueSetSetting(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) < 2 {
+		reply(ud, "queue: set needs a setting (downloading, seeding or limit) and a number", false)
+		return
+	}
+
+	key, ok := queueSettings[strings.ToLower(tokens[0])]
+	if !ok {
+		reply(ud, fmt.Sprintf("queue: unknown setting %s, use downloading, seeding or limit", tokens[0]), false)
+		return
+	}
+
+	n, err := strconv.Atoi(tokens[1])
+	if err != nil || n < -1 {
+		reply(ud, "queue: the value must be a number, or -1 for unlimited", false)
+		return
+	}
+
+	if err := view.Client.SetConfig(map[string]interface{}{key: n}); err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "queue: "+err.Error(), false)
+		return
+	}
+
+	reply(ud, fmt.Sprintf("queue: %s set to %d", tokens[0], n), false)
+}
+
+// queueMove takes a direction (top, up, down or bottom) and a selector of torrents to move within the queue
+func queueMove(view *View, ud tgbotapi.Update, direction string, tokens []string) {
+	command := "q" + direction
+	if len(tokens) == 0 {
+		reply(ud, command+": needs a selector", false)
+		return
+	}
+
+	torrents, err := view.Select(strings.Join(tokens, ","))
+	if err != nil {
+		reply(ud, command+": "+err.Error(), false)
+		return
+	}
+
+	hashes := make([]string, 0, len(torrents))
+	for _, torrent := range torrents {
+		hashes = append(hashes, torrent.Hash)
+	}
+
+	switch direction {
+	case "top":
+		err = view.Client.QueueTop(hashes...)
+	case "up":
+		err = view.Client.QueueUp(hashes...)
+	case "down":
+		err = view.Client.QueueDown(hashes...)
+	case "bottom":
+		err = view.Client.QueueBottom(hashes...)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, command+": "+err.Error(), false)
+		return
+	}
+
+	if len(torrents) == 1 {
+		reply(ud, fmt.Sprintf("Moved %s: %s", direction, torrents[0].Name), false)
+		return
+	}
+	reply(ud, fmt.Sprintf("Moved %s: %d torrents", direction, len(torrents)), false)
+}
+
+// torrentOptions maps the options that "options" can set to the kind of value they take
+var torrentOptions = map[string]string{
+	"stop_at_ratio":   "bool",
+	"stop_ratio":      "float",
+	"remove_at_ratio": "bool",
+	"auto_managed":    "bool",
+	"max_connections": "int",
+}
+
+// options takes an ID of a torrent to show its seeding options, or a selector,
+// an option and a value to set that option on the selected torrents.
+func options(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		reply(ud, "options: needs a torrent ID, or a selector, an option and a value", false)
+		return
+	}
+
+	if len(tokens) == 1 {
+		num, err := strconv.Atoi(tokens[0])
+		if err != nil {
+			reply(ud, fmt.Sprintf("options: %s is not a number", tokens[0]), false)
+			return
+		}
+
+		torrent, err := view.GetTorrentByID(num)
+		if err != nil {
+			reply(ud, "options: "+err.Error(), false)
+			return
+		}
+
+		// get an updated view of that torrent
+		torrent, err = view.Client.GetTorrent(torrent.Hash)
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			reply(ud, "options: "+err.Error(), false)
+			return
+		}
+
+		send(fmt.Sprintf("`<%d>` *%s*\nStop at ratio: *%t* (*%.2f*)\nRemove at ratio: *%t*\nAuto managed: *%t*\nMax connections: *%d*\nSeeding time: *%s*",
+			num, mdReplacer.Replace(torrent.Name), torrent.StopAtRatio, torrent.StopRatio, torrent.RemoveAtRatio,
+			torrent.IsAutoManaged, torrent.MaxConnections, time.Duration(torrent.SeedingTime)*time.Second),
+			ud.Message.Chat.ID, true)
+		return
+	}
+
+	if len(tokens) < 3 {
+		reply(ud, "options: needs a selector, an option and a value", false)
+		return
+	}
+
+	name := strings.ToLower(tokens[1])
+	kind, ok := torrentOptions[name]
+	if !ok {
+		reply(ud, fmt.Sprintf("options: unknown option %s", tokens[1]), false)
+		return
+	}
+
+	var (
+		value interface{}
+		err   error
+	)
+	switch kind {
+	case "bool":
+		value, err = strconv.ParseBool(tokens[2])
+	case "float":
+		value, err = strconv.ParseFloat(tokens[2], 64)
+	case "int":
+		value, err = strconv.Atoi(tokens[2])
+	}
+	if err != nil {
+		reply(ud, fmt.Sprintf("options: %s takes a %s value", name, kind), false)
+		return
+	}
+
+	torrents, err := view.Select(tokens[0])
+	if err != nil {
+		reply(ud, "options: "+err.Error(), false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	for _, torrent := range torrents {
+		if err := view.Client.SetTorrentOptions(torrent.Hash, map[string]interface{}{name: value}); err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			buf.WriteString(fmt.Sprintf("Failed: %s\n", torrent.Name))
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("Set %s to %v: %s\n", name, value, torrent.Name))
+	}
+
+	reply(ud, buf.String(), false)
+}
+
+// hosts lists the daemons known to the Web UI along with their status
+func hosts(view *View, ud tgbotapi.Update) {
+	list, err := view.Client.Hosts()
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		send("hosts: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	for i, host := range list {
+		// the status is only known after asking for it
+		if status, err := view.Client.HostStatus(host.ID); err == nil {
+			host = status
+		} else {
+			log.Printf("[ERROR] Deluge: %s", err)
+		}
+
+		buf.WriteString(fmt.Sprintf("<%d> %s *%s*", i+1, host, host.Status))
+		if host.Version != "" {
+			buf.WriteString(" " + host.Version)
+		}
+		buf.WriteString(fmt.Sprintf("\n`%s`\n", host.ID))
+	}
+
+	if buf.Len() == 0 {
+		send("hosts: The Web UI knows no daemons", ud.Message.Chat.ID, false)
+		return
+	}
+	send(buf.String(), ud.Message.Chat.ID, true)
+}
+
+// connect takes a daemon's number as listed by "hosts", its host[:port] or its ID to connect the Web UI to it
+func connect(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		reply(ud, "connect: needs a host", false)
+		return
+	}
+
+	list, err := view.Client.Hosts()
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "connect: "+err.Error(), false)
+		return
+	}
+
+	var host *deluge.Host
+	for i, h := range list {
+		if tokens[0] == strconv.Itoa(i+1) || h.Matches(tokens[0]) {
+			host = h
+			break
+		}
+	}
+	if host == nil {
+		reply(ud, fmt.Sprintf("connect: no such host %s, try hosts", tokens[0]), false)
+		return
+	}
+
+	// the Web UI stays connected to its current daemon unless we disconnect it first
+	if connected, err := view.Client.Connected(); err == nil && connected {
+		if err := view.Client.Disconnect(); err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			reply(ud, "connect: "+err.Error(), false)
+			return
+		}
+	}
+
+	if err := view.Client.Connect(host.ID); err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		reply(ud, "connect: "+err.Error(), false)
+		return
+	}
+
+	// IDs belong to the old daemon's torrents
+	view.Torrents = nil
+	reply(ud, "Connected to: "+host.String(), false)
+}
+
+// speed will echo back the current download and upload speeds, of every backend if it gets 'all'
+func speed(view *View, ud tgbotapi.Update, tokens []string) {
+	rates := func() (string, error) {
+		download, upload, err := view.Client.SpeedRate()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("↓ *%s*  ↑ *%s*", humanize.Bytes(uint64(download)), humanize.Bytes(uint64(upload))), nil
+	}
+	if len(tokens) > 0 && strings.ToLower(tokens[0]) == "all" {
+		rates = func() (string, error) { return speedAll(), nil }
+	}
+
+	// keep track of the returned message ID from 'send()' to edit the message.
+	var (
+		msgID   int
+		lastErr error
+	)
+	if !hold(&liveMessages) {
+		return
+	}
+	defer liveMessages.Done()
+	for i := 0; i < duration; i++ {
+		msg, err := rates()
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			lastErr = err
+			continue
+		}
+
+		// if we haven't send a message, send it and save the message ID to edit it the next iteration
+		if msgID == 0 {
+			msgID = send(msg, ud.Message.Chat.ID, true)
+			if !liveSleep() {
+				break
+			}
+			continue
+		}
+
+		// we have sent the message, let's update.
+		editConf := tgbotapi.NewEditMessageText(ud.Message.Chat.ID, msgID, msg)
+		editConf.ParseMode = tgbotapi.ModeMarkdown
+		Bot.Send(editConf)
+		if !liveSleep() {
+			break
+		}
+	}
+
+	// nothing got sent if the speeds couldn't be had
+	if msgID == 0 {
+		if lastErr != nil {
+			send("speed: "+lastErr.Error(), ud.Message.Chat.ID, false)
+		}
+		return
+	}
+
+	// after the last iteration, show dashes to indicate that we are done updating.
+	editConf := tgbotapi.NewEditMessageText(ud.Message.Chat.ID, msgID, "↓ *- B*  ↑ *- B*")
+	editConf.ParseMode = tgbotapi.ModeMarkdown
+	Bot.Send(editConf)
+}
+
+// count returns states with torrents count, of every backend if it gets 'all'
+func count(view *View, ud tgbotapi.Update, tokens []string) {
+	if len(tokens) > 0 && strings.ToLower(tokens[0]) == "all" {
+		send(countAll(), ud.Message.Chat.ID, true)
+		return
+	}
+
+	state, trackers, err := view.Client.FilterTree()
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		send("count: "+err.Error(), ud.Message.Chat.ID, false)
 		return
 	}
 
@@ -1220,10 +2286,10 @@ func count(ud tgbotapi.Update) {
 }
 
 // del takes an id or more, and delete the corresponding torrent/s
-func del(ud tgbotapi.Update, tokens []string) {
+func del(view *View, ud tgbotapi.Update, tokens []string) {
 	// make sure that we got an argument
 	if len(tokens) == 0 {
-		send("del: needs an ID", ud.Message.Chat.ID, false)
+		reply(ud, "del: needs an ID", false)
 		return
 	}
 
@@ -1231,31 +2297,31 @@ func del(ud tgbotapi.Update, tokens []string) {
 	for _, id := range tokens {
 		num, err := strconv.Atoi(id)
 		if err != nil {
-			send(fmt.Sprintf("del: %s is not an ID", id), ud.Message.Chat.ID, false)
+			reply(ud, fmt.Sprintf("del: %s is not an ID", id), false)
 			return
 		}
 
 		torrent, err := view.GetTorrentByID(num)
 		if err != nil {
-			send("del: "+err.Error(), ud.Message.Chat.ID, false)
+			reply(ud, "del: "+err.Error(), false)
 			continue
 		}
 
-		if err := Client.RemoveTorrent(torrent.Hash, false); err != nil {
+		if err := view.Client.RemoveTorrent(torrent.Hash, false); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
-			send("send: "+err.Error(), ud.Message.Chat.ID, false)
+			reply(ud, "send: "+err.Error(), false)
 			continue
 		}
 
-		send("Deleted: "+torrent.Name, ud.Message.Chat.ID, false)
+		reply(ud, "Deleted: "+torrent.Name, false)
 	}
 }
 
 // deldata takes an id or more, and delete the corresponding torrent/s with their data
-func deldata(ud tgbotapi.Update, tokens []string) {
+func deldata(view *View, ud tgbotapi.Update, tokens []string) {
 	// make sure that we got an argument
 	if len(tokens) == 0 {
-		send("deldata: needs an ID", ud.Message.Chat.ID, false)
+		reply(ud, "deldata: needs an ID", false)
 		return
 	}
 
@@ -1263,29 +2329,29 @@ func deldata(ud tgbotapi.Update, tokens []string) {
 	for _, id := range tokens {
 		num, err := strconv.Atoi(id)
 		if err != nil {
-			send(fmt.Sprintf("deldata: %s is not an ID", id), ud.Message.Chat.ID, false)
+			reply(ud, fmt.Sprintf("deldata: %s is not an ID", id), false)
 			return
 		}
 
 		torrent, err := view.GetTorrentByID(num)
 		if err != nil {
-			send("deldata: "+err.Error(), ud.Message.Chat.ID, false)
+			reply(ud, "deldata: "+err.Error(), false)
 			continue
 		}
 
-		if err := Client.RemoveTorrent(torrent.Hash, true); err != nil {
+		if err := view.Client.RemoveTorrent(torrent.Hash, true); err != nil {
 			log.Printf("[ERROR] Deluge: %s", err)
-			send("send: "+err.Error(), ud.Message.Chat.ID, false)
+			reply(ud, "send: "+err.Error(), false)
 			continue
 		}
 
-		send("Deleted with data: "+torrent.Name, ud.Message.Chat.ID, false)
+		reply(ud, "Deleted with data: "+torrent.Name, false)
 	}
 }
 
 // version sends deluge/libtorrent and deluge-telegram versions
-func version(ud tgbotapi.Update) {
-	deluge, libtorrent, err := Client.Version()
+func version(view *View, ud tgbotapi.Update) {
+	deluge, libtorrent, err := view.Client.Version()
 	if err != nil {
 		log.Printf("[ERROR] Deluge: %s", err)
 		send("version: "+err.Error(), ud.Message.Chat.ID, false)
@@ -1296,6 +2362,26 @@ func version(ud tgbotapi.Update) {
 		deluge, libtorrent, VERSION), ud.Message.Chat.ID, true)
 }
 
+// notify sends text to ChatID, or to the last chat the master talked in if it isn't set
+func notify(text string, markdown bool) {
+	chatID := ChatID
+	if chatID == 0 {
+		chatID = atomic.LoadInt64(&lastChatID)
+	}
+
+	if chatID == 0 {
+		log.Printf("[INFO] No chat to notify yet, dropped: %s", text)
+		return
+	}
+	send(text, chatID, markdown)
+}
+
+// reply sends a reply to the chat of ud, the commands that change something reply through it
+// so their replies end up in the audit log.
+func reply(ud tgbotapi.Update, text string, markdown bool) int {
+	return recorderOf(ud).send(text, ud.Message.Chat.ID, markdown)
+}
+
 // send takes a chat id and a message to send, returns the message id of the send message
 func send(text string, chatID int64, markdown bool) int {
 	// set typing action
@@ -1319,7 +2405,7 @@ LenCheck:
 
 		// send current chunk
 		if _, err := Bot.Send(msg); err != nil {
-			log.Printf("[ERROR] Send: %s", err)
+			sendFailed(err)
 		}
 		// move to the next chunk
 		text = text[stop:]
@@ -1336,7 +2422,7 @@ LenCheck:
 
 	resp, err := Bot.Send(msg)
 	if err != nil {
-		log.Printf("[ERROR] Send: %s", err)
+		sendFailed(err)
 	}
 
 	return resp.MessageID
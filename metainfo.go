@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Metainfo is what's in a .torrent file
+type Metainfo struct {
+	Hash        string // the v1 info hash in lower case hex
+	Name        string
+	Size        float64
+	PieceLength int64
+	Private     bool
+	Trackers    []string
+	Files       []*MetaFile // in the torrent's order, which is the order of Deluge's file indexes
+}
+
+// MetaFile is a file within a .torrent, Path starts with the torrent's name for multi file torrents
+type MetaFile struct {
+	Path string
+	Size float64
+}
+
+// parseMetainfo decodes a .torrent file
+func parseMetainfo(data []byte) (*Metainfo, error) {
+	raw, err := bdecodeRaw(data)
+	if err != nil {
+		return nil, err
+	}
+	if raw["info"] == nil {
+		return nil, fmt.Errorf("not a .torrent file, it has no info")
+	}
+
+	v, err := bdecode(raw["info"])
+	if err != nil {
+		return nil, err
+	}
+	info, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a .torrent file, its info isn't a dictionary")
+	}
+
+	sum := sha1.Sum(raw["info"])
+	mi := &Metainfo{Hash: hex.EncodeToString(sum[:])}
+	mi.Name, _ = info["name"].(string)
+	mi.PieceLength, _ = info["piece length"].(int64)
+	if private, _ := info["private"].(int64); private == 1 {
+		mi.Private = true
+	}
+
+	// single file torrents have a length, multi file ones have files with lengths
+	if length, ok := info["length"].(int64); ok {
+		mi.Files = append(mi.Files, &MetaFile{Path: mi.Name, Size: float64(length)})
+	}
+	files, _ := info["files"].([]interface{})
+	for _, f := range files {
+		file, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		length, _ := file["length"].(int64)
+
+		parts := []string{mi.Name}
+		list, _ := file["path"].([]interface{})
+		for _, p := range list {
+			if s, ok := p.(string); ok {
+				parts = append(parts, s)
+			}
+		}
+		mi.Files = append(mi.Files, &MetaFile{Path: strings.Join(parts, "/"), Size: float64(length)})
+	}
+	for _, f := range mi.Files {
+		mi.Size += f.Size
+	}
+
+	// the tiers of announce-list, or the single announce if there's none
+	seen := make(map[string]bool)
+	if v, err := bdecode(raw["announce-list"]); err == nil {
+		tiers, _ := v.([]interface{})
+		for _, t := range tiers {
+			tier, _ := t.([]interface{})
+			for _, u := range tier {
+				if s, ok := u.(string); ok && !seen[s] {
+					seen[s] = true
+					mi.Trackers = append(mi.Trackers, s)
+				}
+			}
+		}
+	}
+	if v, err := bdecode(raw["announce"]); err == nil && len(mi.Trackers) == 0 {
+		if s, ok := v.(string); ok {
+			mi.Trackers = append(mi.Trackers, s)
+		}
+	}
+
+	return mi, nil
+}
+
+// meta returns what duplicate checks need to know about the torrent
+func (mi *Metainfo) meta() *torrentMeta {
+	return &torrentMeta{Hash: mi.Hash, Name: mi.Name, Size: mi.Size}
+}
+
+// preview formats the metainfo for a message
+func (mi *Metainfo) preview() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(fmt.Sprintf("*%s*\n", mdReplacer.Replace(mi.Name)))
+	buf.WriteString(fmt.Sprintf("Size: *%s* in *%d* files, pieces of *%s*\n",
+		humanize.Bytes(uint64(mi.Size)), len(mi.Files), humanize.Bytes(uint64(mi.PieceLength))))
+	if mi.Private {
+		buf.WriteString("Private: *yes*\n")
+	}
+	buf.WriteString(fmt.Sprintf("Hash: `%s`\n", mi.Hash))
+
+	for i, tracker := range mi.Trackers {
+		if i == 5 {
+			buf.WriteString(fmt.Sprintf("and %d more trackers\n", len(mi.Trackers)-i))
+			break
+		}
+		buf.WriteString(fmt.Sprintf("Tracker: `%s`\n", tracker))
+	}
+	return buf.String()
+}
+
+// torrentPreview is a .torrent file waiting on the buttons of its preview to be added
+type torrentPreview struct {
+	sync.Mutex
+	view   *View
+	chatID int64
+	msgID  int
+	name   string
+	data   []byte
+	mi     *Metainfo
+
+	wanted []bool // the files to download, by index
+	page   int    // of the file chooser
+	done   bool   // added or cancelled, the buttons do nothing anymore
+}
+
+// how many files a page of the file chooser lists
+var chooserPageSize = 20
+
+// receiveTorrent decodes a .torrent file sent via Telegram and previews it with buttons to add it
+func receiveTorrent(view *View, ud tgbotapi.Update) {
+	if ud.Message.Document == nil || ud.Message.Document.FileID == "" {
+		return // has no document
+	}
+
+	// get the file ID and make the config
+	fconfig := tgbotapi.FileConfig{
+		FileID: ud.Message.Document.FileID,
+	}
+	file, err := Bot.GetFile(fconfig)
+	if err != nil {
+		send("receiver: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	data, err := fetchTorrent(file.Link(BotToken))
+	if err != nil {
+		send("receiver: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	mi, err := parseMetainfo(data)
+	if err != nil {
+		send("receiver: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	p := &torrentPreview{
+		view:   view,
+		chatID: ud.Message.Chat.ID,
+		name:   ud.Message.Document.FileName,
+		data:   data,
+		mi:     mi,
+		wanted: make([]bool, len(mi.Files)),
+	}
+	for i := range p.wanted {
+		p.wanted[i] = true
+	}
+	if p.name == "" {
+		p.name = mi.Name + ".torrent"
+	}
+
+	if handleDuplicate(view, nil, p.chatID, mi.meta(), p.add) {
+		return
+	}
+
+	p.msgID = sendButtons(mi.preview(), p.chatID, true, p.previewButtons()...)
+}
+
+// add adds the torrent with the chosen files, it has the signature handleDuplicate takes
+func (p *torrentPreview) add(options map[string]interface{}) (string, error) {
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+
+	// only pass the priorities if some files are left out, 0 skips a file and 1 is normal
+	priorities := make([]int, len(p.wanted))
+	skipped := 0
+	for i, wanted := range p.wanted {
+		if wanted {
+			priorities[i] = 1
+		} else {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		options["file_priorities"] = priorities
+	}
+
+	return p.view.Client.AddTorrentFile(p.name, base64.StdEncoding.EncodeToString(p.data), options)
+}
+
+// addButtons are Add and Add paused, audited with the torrent they add
+func (p *torrentPreview) addButtons() []tgbotapi.InlineKeyboardButton {
+	added := deluge.Torrents{{Hash: p.mi.Hash, Name: p.mi.Name}}
+	return tgbotapi.NewInlineKeyboardRow(
+		newAuditedButton("Add", p.view, "add "+p.mi.Name, added, p.press(func() string { return p.finish(false) })),
+		newAuditedButton("Add paused", p.view, "add paused "+p.mi.Name, added, p.press(func() string { return p.finish(true) })),
+	)
+}
+
+// previewButtons are Add, Add paused, Choose files and Cancel
+func (p *torrentPreview) previewButtons() [][]tgbotapi.InlineKeyboardButton {
+	rows := [][]tgbotapi.InlineKeyboardButton{p.addButtons()}
+
+	last := tgbotapi.NewInlineKeyboardRow(newButton("Cancel", p.press(p.cancel)))
+	if len(p.mi.Files) > 1 {
+		last = append([]tgbotapi.InlineKeyboardButton{newButton("Choose files", p.press(func() string {
+			p.edit(p.chooserText(), true, p.chooserButtons())
+			return ""
+		}))}, last...)
+	}
+	return append(rows, last)
+}
+
+// chooserText sums up the files that are chosen, the chooser's buttons list them
+func (p *torrentPreview) chooserText() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(fmt.Sprintf("*%s*\nTap the files to leave out or take back:\n", mdReplacer.Replace(p.mi.Name)))
+
+	var size float64
+	count := 0
+	for i, f := range p.mi.Files {
+		if p.wanted[i] {
+			size += f.Size
+			count++
+		}
+	}
+	buf.WriteString(fmt.Sprintf("*%d* of *%d* files, *%s*", count, len(p.mi.Files), humanize.Bytes(uint64(size))))
+	if pages := p.pages(); pages > 1 {
+		buf.WriteString(fmt.Sprintf(", page *%d* of *%d*", p.page+1, pages))
+	}
+	return buf.String()
+}
+
+func (p *torrentPreview) pages() int {
+	return (len(p.mi.Files) + chooserPageSize - 1) / chooserPageSize
+}
+
+// chooserButtons are a toggle for each file of the page, the pages, and the ways to be done with it
+func (p *torrentPreview) chooserButtons() [][]tgbotapi.InlineKeyboardButton {
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	from := p.page * chooserPageSize
+	for i := from; i < len(p.mi.Files) && i < from+chooserPageSize; i++ {
+		i := i
+		mark := "✅"
+		if !p.wanted[i] {
+			mark = "⬜"
+		}
+
+		// the torrent's name is the same for every file
+		path := []rune(strings.TrimPrefix(p.mi.Files[i].Path, p.mi.Name+"/"))
+		if len(path) > 40 {
+			path = append([]rune("…"), path[len(path)-40:]...)
+		}
+		label := fmt.Sprintf("%s %s (%s)", mark, string(path), humanize.Bytes(uint64(p.mi.Files[i].Size)))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(newButton(label, p.press(func() string {
+			p.wanted[i] = !p.wanted[i]
+			p.edit(p.chooserText(), true, p.chooserButtons())
+			return ""
+		}))))
+	}
+
+	// all or none of them, and the pages
+	setAll := func(wanted bool) func() string {
+		return func() string {
+			for i := range p.wanted {
+				p.wanted[i] = wanted
+			}
+			p.edit(p.chooserText(), true, p.chooserButtons())
+			return ""
+		}
+	}
+	nav := tgbotapi.NewInlineKeyboardRow(newButton("All", p.press(setAll(true))), newButton("None", p.press(setAll(false))))
+	if p.page > 0 {
+		nav = append(nav, newButton("◀", p.press(func() string {
+			p.page--
+			p.edit(p.chooserText(), true, p.chooserButtons())
+			return ""
+		})))
+	}
+	if p.page < p.pages()-1 {
+		nav = append(nav, newButton("▶", p.press(func() string {
+			p.page++
+			p.edit(p.chooserText(), true, p.chooserButtons())
+			return ""
+		})))
+	}
+	rows = append(rows, nav)
+
+	return append(rows, append(p.addButtons(), newButton("Cancel", p.press(p.cancel))))
+}
+
+// press wraps a button's action so the preview's buttons are pressed one at a time,
+// and do nothing once it's added or cancelled.
+func (p *torrentPreview) press(action func() string) buttonAction {
+	return func(*tgbotapi.CallbackQuery) string {
+		p.Lock()
+		defer p.Unlock()
+		if p.done {
+			return "Already done with"
+		}
+		return action()
+	}
+}
+
+// finish adds the torrent with the chosen files, paused or not
+func (p *torrentPreview) finish(paused bool) string {
+	for i, wanted := range p.wanted {
+		if wanted {
+			break
+		}
+		if i == len(p.wanted)-1 {
+			return "Choose at least one file"
+		}
+	}
+
+	var options map[string]interface{}
+	if paused {
+		options = map[string]interface{}{"add_paused": true}
+	}
+	hash, err := p.add(options)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		return err.Error()
+	}
+
+	p.done = true
+	note := "Added"
+	if paused {
+		note = "Added paused"
+	}
+	p.edit(p.mi.preview()+"\n_"+note+"_", true, nil)
+
+	torrent, err := p.view.Client.GetTorrent(hash, addedFields...)
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+	} else if warning := spaceWarning(p.view, torrent); warning != "" {
+		send(warning, p.chatID, false)
+	}
+	return note
+}
+
+// cancel drops the preview's buttons without adding the torrent
+func (p *torrentPreview) cancel() string {
+	p.done = true
+	p.edit(p.mi.preview()+"\n_Cancelled_", true, nil)
+	return "Cancelled"
+}
+
+// edit replaces the preview message's text and buttons, no buttons drops them
+func (p *torrentPreview) edit(text string, markdown bool, rows [][]tgbotapi.InlineKeyboardButton) {
+	editConf := tgbotapi.NewEditMessageText(p.chatID, p.msgID, text)
+	if markdown {
+		editConf.ParseMode = tgbotapi.ModeMarkdown
+	}
+	if len(rows) > 0 {
+		markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+		editConf.ReplyMarkup = &markup
+	}
+	if _, err := Bot.Send(editConf); err != nil {
+		sendFailed(err)
+	}
+}
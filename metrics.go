@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	deluge "go-deluge"
+)
+
+// rpcStat is the latency histogram and error count of a Deluge RPC method
+type rpcStat struct {
+	buckets []uint64 // cumulative, as Prometheus has them
+	count   uint64
+	sum     float64
+	errors  uint64
+}
+
+var (
+	// the address to serve Prometheus metrics and health checks at, e.g. :9090, none if empty
+	MetricsAddr string
+
+	// the upper bounds of the RPC latency buckets, in seconds
+	rpcBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// the bot's internals, guarded by metricsMu
+	metricsMu     sync.Mutex
+	commandCounts = make(map[string]uint64)
+	rpcStats      = make(map[[2]string]*rpcStat) // by backend and method
+	reauthCounts  = make(map[string]uint64)      // by backend
+	loggedIn      = make(map[string]bool)        // whether a backend has logged in yet
+	sendFailures  uint64
+)
+
+// observeRPC is the OnRequest of a backend's client, it keeps the latency and errors of every method
+// and counts the logins after the first successful one, as that's when the session expired.
+func observeRPC(backend string) func(string, time.Duration, error) {
+	return func(method string, took time.Duration, err error) {
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+
+		key := [2]string{backend, method}
+		stat, ok := rpcStats[key]
+		if !ok {
+			stat = &rpcStat{buckets: make([]uint64, len(rpcBuckets))}
+			rpcStats[key] = stat
+		}
+
+		seconds := took.Seconds()
+		for i, bound := range rpcBuckets {
+			if seconds <= bound {
+				stat.buckets[i]++
+			}
+		}
+		stat.count++
+		stat.sum += seconds
+		if err != nil {
+			stat.errors++
+		}
+
+		if method == "auth.login" && err == nil {
+			if loggedIn[backend] {
+				reauthCounts[backend]++
+			}
+			loggedIn[backend] = true
+		}
+	}
+}
+
+// countCommand counts a command handled by the bot, commands that don't exist count as "unknown"
+// so typos don't make a metric each.
+func countCommand(command string, known bool) {
+	command = strings.TrimPrefix(command, "/")
+	if !known {
+		command = "unknown"
+	}
+	if command == "" {
+		command = "file"
+	}
+
+	metricsMu.Lock()
+	commandCounts[command]++
+	metricsMu.Unlock()
+}
+
+// sendFailed logs and counts a message that couldn't be sent to Telegram
+func sendFailed(err error) {
+	log.Printf("[ERROR] Send: %s", err)
+
+	metricsMu.Lock()
+	sendFailures++
+	metricsMu.Unlock()
+}
+
+// serveMetrics serves the metrics and health checks at MetricsAddr, it runs in its own go-routine.
+func serveMetrics() {
+	if MetricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	log.Printf("[INFO] Serving metrics at %s/metrics", MetricsAddr)
+	if err := http.ListenAndServe(MetricsAddr, mux); err != nil {
+		log.Printf("[ERROR] Metrics: %s", err)
+	}
+}
+
+// metricsWriter writes metrics in Prometheus' text format, the samples of a metric get grouped
+// under a single HELP and TYPE in the order the metrics first show up.
+type metricsWriter struct {
+	families []string
+	samples  map[string]*bytes.Buffer
+}
+
+func newMetricsWriter() *metricsWriter {
+	return &metricsWriter{samples: make(map[string]*bytes.Buffer)}
+}
+
+// labelReplacer escapes label values
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// write writes a sample of the metric name, labels come in name, value pairs
+func (w *metricsWriter) write(name, typ, help string, value float64, labels ...string) {
+	// a histogram's samples are named after it with a suffix
+	family := name
+	if typ == "histogram" {
+		family = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+	}
+
+	buf, ok := w.samples[family]
+	if !ok {
+		buf = new(bytes.Buffer)
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", family, help, family, typ)
+		w.samples[family] = buf
+		w.families = append(w.families, family)
+	}
+
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, `%s="%s"`, labels[i], labelReplacer.Replace(labels[i+1]))
+		}
+		buf.WriteString("}")
+	}
+	fmt.Fprintf(buf, " %g\n", value)
+}
+
+// bytes returns everything that got written
+func (w *metricsWriter) bytes() []byte {
+	out := new(bytes.Buffer)
+	for _, family := range w.families {
+		out.Write(w.samples[family].Bytes())
+	}
+	return out.Bytes()
+}
+
+// metricsHandler asks every backend for its numbers and writes them along with the bot's internals
+func metricsHandler(rw http.ResponseWriter, r *http.Request) {
+	w := newMetricsWriter()
+
+	for _, v := range views {
+		up := 1.0
+		if err := writeDelugeMetrics(w, v); err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			up = 0
+		}
+		w.write("deluge_up", "gauge", "Whether the backend answered the last scrape.", up, "backend", v.Name)
+	}
+
+	metricsMu.Lock()
+	for command, n := range commandCounts {
+		w.write("deluge_telegram_commands_total", "counter", "Commands handled by the bot, by name.",
+			float64(n), "command", command)
+	}
+	for key, stat := range rpcStats {
+		for i, bound := range rpcBuckets {
+			w.write("deluge_telegram_rpc_duration_seconds_bucket", "histogram", "Latency of Deluge RPC requests, by method.",
+				float64(stat.buckets[i]), "backend", key[0], "method", key[1], "le", fmt.Sprint(bound))
+		}
+		w.write("deluge_telegram_rpc_duration_seconds_bucket", "histogram", "",
+			float64(stat.count), "backend", key[0], "method", key[1], "le", "+Inf")
+		w.write("deluge_telegram_rpc_duration_seconds_sum", "histogram", "", stat.sum, "backend", key[0], "method", key[1])
+		w.write("deluge_telegram_rpc_duration_seconds_count", "histogram", "", float64(stat.count), "backend", key[0], "method", key[1])
+	}
+	for key, stat := range rpcStats {
+		w.write("deluge_telegram_rpc_errors_total", "counter", "Deluge RPC requests that failed, by method.",
+			float64(stat.errors), "backend", key[0], "method", key[1])
+	}
+	for backend, n := range reauthCounts {
+		w.write("deluge_telegram_reauths_total", "counter", "Logins to the Web UI after its session expired.",
+			float64(n), "backend", backend)
+	}
+	w.write("deluge_telegram_send_failures_total", "counter", "Messages that couldn't be sent to Telegram.", float64(sendFailures))
+	metricsMu.Unlock()
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(w.bytes())
+}
+
+// writeDelugeMetrics writes the torrent counts, rates, free space and label totals of a backend
+func writeDelugeMetrics(w *metricsWriter, v *View) error {
+	states, trackers, err := v.Client.FilterTree()
+	if err != nil {
+		return err
+	}
+	// the filter tree has pairs of a name and a count, and an "All" that's their sum
+	for _, s := range states {
+		if len(s) == 2 && s[0] != "All" {
+			count, _ := s[1].(float64)
+			w.write("deluge_torrents", "gauge", "Torrents by state.", count, "backend", v.Name, "state", fmt.Sprint(s[0]))
+		}
+	}
+	for _, t := range trackers {
+		if len(t) == 2 && t[0] != "All" {
+			count, _ := t[1].(float64)
+			w.write("deluge_tracker_torrents", "gauge", "Torrents by tracker.", count, "backend", v.Name, "tracker", fmt.Sprint(t[0]))
+		}
+	}
+
+	down, up, err := v.Client.SpeedRate()
+	if err != nil {
+		return err
+	}
+	w.write("deluge_download_rate_bytes", "gauge", "Payload download rate in bytes per second.", down, "backend", v.Name)
+	w.write("deluge_upload_rate_bytes", "gauge", "Payload upload rate in bytes per second.", up, "backend", v.Name)
+
+	torrents, err := v.Client.GetTorrents("label", "total_size", "save_path")
+	if err != nil {
+		return err
+	}
+
+	// the default save path, and every other one that's in use
+	paths := []string{""}
+	seen := make(map[string]bool)
+	labels := make(map[string]deluge.Torrents)
+	for _, t := range torrents {
+		if t.SavePath != "" && !seen[t.SavePath] {
+			seen[t.SavePath] = true
+			paths = append(paths, t.SavePath)
+		}
+		labels[t.Label] = append(labels[t.Label], t)
+	}
+
+	for _, path := range paths {
+		free, err := v.Client.FreeSpace(path)
+		if err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			continue
+		}
+		w.write("deluge_free_space_bytes", "gauge", "Free space of the save paths, the default one is \"\".",
+			float64(free), "backend", v.Name, "path", path)
+	}
+
+	for label, ts := range labels {
+		var size float64
+		for _, t := range ts {
+			size += t.TotalSize
+		}
+		w.write("deluge_label_torrents", "gauge", "Torrents by label, unlabeled ones are \"\".",
+			float64(len(ts)), "backend", v.Name, "label", label)
+		w.write("deluge_label_size_bytes", "gauge", "Total size of the torrents by label.", size, "backend", v.Name, "label", label)
+	}
+
+	return nil
+}
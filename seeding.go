@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// SeedRule pauses or removes torrents once they've been seeding for longer than Time,
+// Tracker optionally limits the rule to torrents with a tracker host that matches it.
+// Deluge 1.3 can only stop at a ratio, so seed time rules are applied by the bot.
+type SeedRule struct {
+	Action  string // "pause" or "remove"
+	Time    time.Duration
+	Tracker *regexp.Regexp
+}
+
+var (
+	seedRules   []*SeedRule
+	seedRulesMu sync.Mutex
+
+	// how often the seed rules get applied
+	seedPolicyInterval = time.Minute
+)
+
+// parseSeedRule parses a rule in the form of action:time[:tracker], e.g. "pause:48h:example.org",
+// time is either a duration or a number of hours.
+func parseSeedRule(s string) (*SeedRule, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s is not in the form of action:time[:tracker]", s)
+	}
+
+	rule := &SeedRule{Action: strings.ToLower(parts[0])}
+	if rule.Action != "pause" && rule.Action != "remove" {
+		return nil, fmt.Errorf("unknown action %s, use pause or remove", parts[0])
+	}
+
+	var err error
+	if hours, herr := strconv.ParseFloat(parts[1], 64); herr == nil {
+		rule.Time = time.Duration(hours * float64(time.Hour))
+	} else if rule.Time, err = time.ParseDuration(parts[1]); err != nil {
+		return nil, fmt.Errorf("%s is not a duration or a number of hours", parts[1])
+	}
+	if rule.Time <= 0 {
+		return nil, fmt.Errorf("%s must be more than zero", parts[1])
+	}
+
+	if len(parts) == 3 && parts[2] != "" {
+		// (?i) for case insensitivity
+		if rule.Tracker, err = regexp.Compile("(?i)" + parts[2]); err != nil {
+			return nil, err
+		}
+	}
+
+	return rule, nil
+}
+
+// String formats the rule the same way parseSeedRule takes it
+func (r *SeedRule) String() string {
+	if r.Tracker == nil {
+		return fmt.Sprintf("%s:%s", r.Action, r.Time)
+	}
+	return fmt.Sprintf("%s:%s:%s", r.Action, r.Time, strings.TrimPrefix(r.Tracker.String(), "(?i)"))
+}
+
+// seedRulesFile returns the file the seed rules persist to once they're changed through
+// the bot, or "" if there's no -datadir.
+func seedRulesFile() string {
+	if DataDir == "" {
+		return ""
+	}
+	return filepath.Join(DataDir, "seedpolicy.json")
+}
+
+// loadSeedRules reads the persisted seed rules, they take the place of -seedpolicy's
+func loadSeedRules() {
+	file := seedRulesFile()
+	if file == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Seed policy: %s", err)
+		}
+		return
+	}
+
+	var saved []string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("[ERROR] Seed policy: %s", err)
+		return
+	}
+
+	rules := make([]*SeedRule, 0, len(saved))
+	for _, r := range saved {
+		rule, err := parseSeedRule(r)
+		if err != nil {
+			log.Printf("[ERROR] Seed policy: %s", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	seedRulesMu.Lock()
+	seedRules = rules
+	seedRulesMu.Unlock()
+	log.Printf("[INFO] Seed policy: %d rules from %s", len(rules), file)
+}
+
+// saveSeedRules persists the seed rules, seedRulesMu must be held
+func saveSeedRules() {
+	file := seedRulesFile()
+	if file == "" {
+		return
+	}
+
+	saved := make([]string, len(seedRules))
+	for i, rule := range seedRules {
+		saved[i] = rule.String()
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Printf("[ERROR] Seed policy: %s", err)
+		return
+	}
+
+	// write then rename, so a crash never leaves half a file behind
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		log.Printf("[ERROR] Seed policy: %s", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Printf("[ERROR] Seed policy: %s", err)
+	}
+}
+
+// seedPolicy applies the seed rules to every backend every seedPolicyInterval,
+// it runs in its own go-routine.
+func seedPolicy() {
+	loadSeedRules()
+
+	for sleep(seedPolicyInterval) {
+		for _, view := range views {
+			applySeedRules(view)
+		}
+	}
+}
+
+// applySeedRules pauses or removes the seeding torrents that have a rule that applies to them,
+// the first rule that matches a torrent wins.
+func applySeedRules(view *View) {
+	seedRulesMu.Lock()
+	rules := make([]*SeedRule, len(seedRules))
+	copy(rules, seedRules)
+	seedRulesMu.Unlock()
+
+	if len(rules) == 0 {
+		return
+	}
+
+	torrents, err := view.Client.GetTorrents("name", "state", "seeding_time", "tracker_host")
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		return
+	}
+
+	for _, torrent := range torrents {
+		if torrent.State != "Seeding" {
+			continue
+		}
+
+		seeded := time.Duration(torrent.SeedingTime) * time.Second
+		for _, rule := range rules {
+			if seeded < rule.Time ||
+				(rule.Tracker != nil && !rule.Tracker.MatchString(torrent.TrackerHost)) {
+				continue
+			}
+
+			var done string
+			switch rule.Action {
+			case "pause":
+				err, done = view.Client.PauseTorrent(torrent.Hash), "Paused"
+			case "remove":
+				err, done = view.Client.RemoveTorrent(torrent.Hash, false), "Removed"
+			}
+			if err != nil {
+				log.Printf("[ERROR] Deluge: %s", err)
+				notify(fmt.Sprintf("%sseedpolicy: failed to %s %s: %s", view.Label(), rule.Action, torrent.Name, err), false)
+				break
+			}
+
+			log.Printf("[INFO] Seed policy: %s %s on %s after seeding for %s", rule.Action, torrent.Name, view.Name, seeded)
+			notify(fmt.Sprintf("%sseedpolicy: %s %s after seeding for %s (rule: %s)",
+				view.Label(), done, torrent.Name, seeded, rule), false)
+			break
+		}
+	}
+}
+
+// seedpolicy lists the seed time rules, or adds and deletes them
+func seedpolicy(ud tgbotapi.Update, tokens []string) {
+	if len(tokens) == 0 {
+		seedRulesMu.Lock()
+		buf := new(bytes.Buffer)
+		for i, rule := range seedRules {
+			buf.WriteString(fmt.Sprintf("<%d> %s\n", i+1, rule))
+		}
+		seedRulesMu.Unlock()
+
+		if buf.Len() == 0 {
+			reply(ud, "seedpolicy: No rules", false)
+			return
+		}
+		reply(ud, buf.String(), false)
+		return
+	}
+
+	switch strings.ToLower(tokens[0]) {
+	case "add":
+		if len(tokens) < 3 {
+			reply(ud, "seedpolicy: add needs an action (pause or remove), a time and an optional tracker query", false)
+			return
+		}
+
+		rule, err := parseSeedRule(strings.Join(tokens[1:], ":"))
+		if err != nil {
+			reply(ud, "seedpolicy: "+err.Error(), false)
+			return
+		}
+
+		seedRulesMu.Lock()
+		seedRules = append(seedRules, rule)
+		saveSeedRules()
+		seedRulesMu.Unlock()
+		reply(ud, "seedpolicy: added "+rule.String(), false)
+
+	case "del":
+		if len(tokens) < 2 {
+			reply(ud, "seedpolicy: del needs a rule number", false)
+			return
+		}
+
+		n, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			reply(ud, fmt.Sprintf("seedpolicy: %s is not a number", tokens[1]), false)
+			return
+		}
+
+		seedRulesMu.Lock()
+		if n < 1 || n > len(seedRules) {
+			seedRulesMu.Unlock()
+			reply(ud, fmt.Sprintf("seedpolicy: no rule number %d", n), false)
+			return
+		}
+		rule := seedRules[n-1]
+		seedRules = append(seedRules[:n-1], seedRules[n:]...)
+		saveSeedRules()
+		seedRulesMu.Unlock()
+		reply(ud, "seedpolicy: deleted "+rule.String(), false)
+
+	default:
+		reply(ud, "seedpolicy: takes no argument, add or del", false)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	humanize "github.com/dustin/go-humanize"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Sample is the transfer rates at a point in time, along with a torrent's progress
+// if it's a torrent's sample.
+type Sample struct {
+	Time     int64   `json:"t"` // unix seconds
+	Download float64 `json:"d"`
+	Upload   float64 `json:"u"`
+	Progress float64 `json:"p,omitempty"`
+}
+
+// samples is a fixed size ring of samples, the oldest get overwritten once it's full.
+type samples struct {
+	buf  []Sample
+	next int
+	full bool
+}
+
+func newSamples(size int) *samples {
+	return &samples{buf: make([]Sample, size)}
+}
+
+// add adds s as the newest sample
+func (r *samples) add(s Sample) {
+	r.buf[r.next] = s
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// since returns the samples taken at or after t, oldest first
+func (r *samples) since(t time.Time) []Sample {
+	ordered := r.buf[:r.next]
+	if r.full {
+		ordered = append(append([]Sample{}, r.buf[r.next:]...), r.buf[:r.next]...)
+	}
+
+	from := t.Unix()
+	for i, s := range ordered {
+		if s.Time >= from {
+			return append([]Sample{}, ordered[i:]...)
+		}
+	}
+	return nil
+}
+
+var (
+	// how often the rates get sampled, and how far back they're kept
+	speedHistoryInterval = time.Minute
+	speedHistoryKeep     = 7 * 24 * time.Hour
+	torrentHistoryKeep   = 24 * time.Hour
+
+	// the session's rates by backend name, and each torrent's by backend name and hash
+	speedHistory   = make(map[string]*samples)
+	torrentHistory = make(map[string]map[string]*samples)
+	speedHistoryMu sync.Mutex
+
+	// the fields of the torrents' samples
+	speedHistoryFields = []string{"name", "state", "progress", "download_payload_rate", "upload_payload_rate"}
+)
+
+// speedHistoryFile returns the file the session rates persist to, or "" if there's no -datadir,
+// the torrents' rates are only kept in memory.
+func speedHistoryFile() string {
+	if DataDir == "" {
+		return ""
+	}
+	return filepath.Join(DataDir, "speedhistory.json")
+}
+
+// loadSpeedHistory reads the persisted session rates, if there are any
+func loadSpeedHistory() {
+	file := speedHistoryFile()
+	if file == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Speed history: %s", err)
+		}
+		return
+	}
+
+	saved := make(map[string][]Sample)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("[ERROR] Speed history: %s", err)
+		return
+	}
+
+	speedHistoryMu.Lock()
+	defer speedHistoryMu.Unlock()
+	from := time.Now().Add(-speedHistoryKeep).Unix()
+	for name, list := range saved {
+		r := newSamples(int(speedHistoryKeep / speedHistoryInterval))
+		for _, s := range list {
+			if s.Time >= from {
+				r.add(s)
+			}
+		}
+		speedHistory[name] = r
+	}
+}
+
+// saveSpeedHistory persists the session rates, speedHistoryMu must be held
+func saveSpeedHistory() {
+	file := speedHistoryFile()
+	if file == "" {
+		return
+	}
+
+	saved := make(map[string][]Sample)
+	for name, r := range speedHistory {
+		saved[name] = r.since(time.Time{})
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Printf("[ERROR] Speed history: %s", err)
+		return
+	}
+
+	// write then rename, so a crash never leaves half a file behind
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		log.Printf("[ERROR] Speed history: %s", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Printf("[ERROR] Speed history: %s", err)
+	}
+}
+
+// recordSpeedHistory samples the rates of every backend and of their active torrents
+// every speedHistoryInterval, it runs in its own go-routine.
+func recordSpeedHistory() {
+	loadSpeedHistory()
+
+	for i := 1; ; i++ {
+		for _, v := range views {
+			recordView(v, time.Now())
+		}
+
+		// the session rates are only saved every 10 samples, they're a week worth of them
+		if i%10 == 0 {
+			speedHistoryMu.Lock()
+			saveSpeedHistory()
+			speedHistoryMu.Unlock()
+		}
+
+		if !sleep(speedHistoryInterval) {
+			break
+		}
+	}
+
+	// the rates since the last save would be lost otherwise
+	speedHistoryMu.Lock()
+	saveSpeedHistory()
+	speedHistoryMu.Unlock()
+}
+
+// recordView samples the rates of the view's session, and of its torrents that are
+// downloading, transferring, or were sampled before and are still there.
+func recordView(v *View, now time.Time) {
+	download, upload, err := v.Client.SpeedRate()
+	if err != nil {
+		log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+		return
+	}
+	torrents, err := v.Client.GetTorrents(speedHistoryFields...)
+	if err != nil {
+		log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+		return
+	}
+
+	speedHistoryMu.Lock()
+	defer speedHistoryMu.Unlock()
+
+	r, ok := speedHistory[v.Name]
+	if !ok {
+		r = newSamples(int(speedHistoryKeep / speedHistoryInterval))
+		speedHistory[v.Name] = r
+	}
+	r.add(Sample{Time: now.Unix(), Download: float64(download), Upload: float64(upload)})
+
+	rings, ok := torrentHistory[v.Name]
+	if !ok {
+		rings = make(map[string]*samples)
+		torrentHistory[v.Name] = rings
+	}
+
+	// whether each torrent is still there, and if it's downloading
+	downloading := make(map[string]bool)
+	for _, t := range torrents {
+		downloading[t.Hash] = t.State == "Downloading"
+
+		r, ok := rings[t.Hash]
+		if !ok {
+			if t.State != "Downloading" && t.DownloadPayloadRate == 0 && t.UploadPayloadRate == 0 {
+				continue
+			}
+			r = newSamples(int(torrentHistoryKeep / speedHistoryInterval))
+			rings[t.Hash] = r
+		}
+		r.add(Sample{Time: now.Unix(), Download: t.DownloadPayloadRate, Upload: float64(t.UploadPayloadRate), Progress: t.Progress})
+	}
+
+	// forget the torrents that are gone, and the ones that aren't downloading and
+	// were idle for as long as they're kept
+	for hash, r := range rings {
+		isDownloading, ok := downloading[hash]
+		if !ok {
+			delete(rings, hash)
+			continue
+		}
+		if isDownloading {
+			continue
+		}
+		idle := true
+		for _, s := range r.since(now.Add(-torrentHistoryKeep)) {
+			if s.Download > 0 || s.Upload > 0 {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(rings, hash)
+		}
+	}
+}
+
+// speedSamples returns the session rates of the backend within the last d
+func speedSamples(name string, d time.Duration) []Sample {
+	speedHistoryMu.Lock()
+	defer speedHistoryMu.Unlock()
+
+	r, ok := speedHistory[name]
+	if !ok {
+		return nil
+	}
+	return r.since(time.Now().Add(-d))
+}
+
+// torrentSamples returns the rates and progress of the backend's torrent within the last d
+func torrentSamples(name, hash string, d time.Duration) []Sample {
+	speedHistoryMu.Lock()
+	defer speedHistoryMu.Unlock()
+
+	r, ok := torrentHistory[name][hash]
+	if !ok {
+		return nil
+	}
+	return r.since(time.Now().Add(-d))
+}
+
+// parseSpan parses how far back a graph goes, e.g. "1h", "24h" or "7d"
+func parseSpan(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 1 {
+			return 0, fmt.Errorf("%s is not a valid span", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < speedHistoryInterval {
+		return 0, fmt.Errorf("%s is not a valid span", s)
+	}
+	return d, nil
+}
+
+// downsample averages the samples into buckets of width, so a week of samples
+// doesn't get drawn over the same few pixels.
+func downsample(list []Sample, width time.Duration) []Sample {
+	if width <= speedHistoryInterval {
+		return list
+	}
+
+	var (
+		out   []Sample
+		sum   Sample
+		count float64
+	)
+	bucket := int64(width / time.Second)
+	for i, s := range list {
+		sum.Download += s.Download
+		sum.Upload += s.Upload
+		sum.Progress = s.Progress // progress only goes up, the last one will do
+		count++
+
+		if i == len(list)-1 || list[i+1].Time/bucket != s.Time/bucket {
+			out = append(out, Sample{Time: s.Time / bucket * bucket, Download: sum.Download / count,
+				Upload: sum.Upload / count, Progress: sum.Progress})
+			sum, count = Sample{}, 0
+		}
+	}
+	return out
+}
+
+// graph sends a chart of the download and upload rates within the last 1h, 24h, 7d etc,
+// or of a torrent's progress and rates if it gets a torrent's ID.
+func graph(view *View, ud tgbotapi.Update, tokens []string) {
+	span := 24 * time.Hour
+	var torrent *deluge.Torrent
+	for _, token := range tokens {
+		if id, err := strconv.Atoi(token); err == nil {
+			if torrent, err = view.GetTorrentByID(id); err != nil {
+				send("graph: "+err.Error(), ud.Message.Chat.ID, false)
+				return
+			}
+			continue
+		}
+
+		d, err := parseSpan(strings.ToLower(token))
+		if err != nil {
+			send("graph: "+err.Error(), ud.Message.Chat.ID, false)
+			return
+		}
+		span = d
+	}
+
+	limit := speedHistoryKeep
+	if torrent != nil {
+		limit = torrentHistoryKeep
+	}
+	if span > limit {
+		span = limit
+	}
+
+	var list []Sample
+	if torrent != nil {
+		list = torrentSamples(view.Name, torrent.Hash, span)
+	} else {
+		list = speedSamples(view.Name, span)
+	}
+
+	// about a bucket for every other pixel
+	width := span / time.Duration(chartWidth/2)
+	list = downsample(list, width)
+	if width < speedHistoryInterval {
+		width = speedHistoryInterval
+	}
+
+	times := make([]time.Time, len(list))
+	download, upload, progress := make([]float64, len(list)), make([]float64, len(list)), make([]float64, len(list))
+	for i, s := range list {
+		times[i] = time.Unix(s.Time, 0)
+		download[i], upload[i], progress[i] = s.Download, s.Upload, s.Progress
+	}
+
+	rate := func(v float64) string { return humanize.Bytes(uint64(v)) + "/s" }
+	rates := chartPanel{
+		Series: []chartSeries{{"Download", chartDownload, download}, {"Upload", chartUpload, upload}},
+		Format: rate,
+	}
+
+	now := time.Now()
+	title := fmt.Sprintf("%sRates over the last %s", view.Label(), formatSpan(span))
+	panels := []chartPanel{rates}
+	if torrent != nil {
+		name := torrent.Name
+		if utf8.RuneCountInString(name) > 80 {
+			name = string([]rune(name)[:80]) + "…"
+		}
+		title = fmt.Sprintf("%s, last %s", name, formatSpan(span))
+		panels = []chartPanel{{
+			Series: []chartSeries{{"Progress", chartProgress, progress}},
+			Max:    100,
+			Format: func(v float64) string { return fmt.Sprintf("%.0f%%", v) },
+		}, rates}
+	}
+
+	data, err := renderChart(title, now.Add(-span), now, times, width, panels...)
+	if err != nil {
+		send("graph: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	photo := tgbotapi.NewPhotoUpload(ud.Message.Chat.ID, tgbotapi.FileBytes{Name: "graph.png", Bytes: data})
+	if _, err := Bot.Send(photo); err != nil {
+		sendFailed(err)
+	}
+}
+
+// formatSpan formats a span the way it's given to graph, e.g. "1h" or "7d"
+func formatSpan(d time.Duration) string {
+	if d > 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(d.String(), "0s"), "0m")
+}
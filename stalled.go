@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	deluge "go-deluge"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// StallRule pauses, removes or reannounces torrents that have been stuck for longer than Time.
+type StallRule struct {
+	Action string // "pause", "remove" or "reannounce"
+	Time   time.Duration
+}
+
+// stuckTorrent is how far a downloading torrent got, and since when it's been there,
+// along with what was done about it so a restart doesn't do it again
+type stuckTorrent struct {
+	Done    float64         `json:"done"`
+	Since   time.Time       `json:"since"`
+	Alerted bool            `json:"alerted,omitempty"`
+	Applied map[string]bool `json:"applied,omitempty"` // the rules applied to it, as they're formatted
+}
+
+// stallTracker keeps up with a backend's downloading torrents to tell which are stuck
+type stallTracker struct {
+	delta    *deluge.Delta // only trackStalled's go-routine uses it
+	torrents deluge.Torrents
+	stuck    map[string]*stuckTorrent // by hash
+}
+
+// stall is a stalled torrent along with what's left to do about it
+type stall struct {
+	torrent *deluge.Torrent
+	stuck   time.Duration
+	reasons []string
+	alert   bool
+	rules   []*StallRule
+}
+
+var (
+	// how long a downloading torrent can go without progress before it's stalled
+	StallTime = 24 * time.Hour
+	// how long a torrent without seeds or a download rate can go before it's stalled,
+	// so freshly started torrents get a chance to find peers
+	stallGrace = 10 * time.Minute
+	// alert about torrents once they stall
+	StallAlerts bool
+
+	stallRules []*StallRule
+
+	// the trackers by backend name
+	stallTrackers   = make(map[string]*stallTracker)
+	stallTrackersMu sync.Mutex
+
+	stallInterval = time.Minute
+	stallFields   = []string{"name", "state", "progress", "total_done", "download_payload_rate", "total_seeds", "distributed_copies"}
+)
+
+// parseStallRule parses a rule in the form of action:time, e.g. "reannounce:6h",
+// time is either a duration or a number of hours.
+func parseStallRule(s string) (*StallRule, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s is not in the form of action:time", s)
+	}
+
+	rule := &StallRule{Action: strings.ToLower(parts[0])}
+	switch rule.Action {
+	case "pause", "remove", "reannounce":
+	default:
+		return nil, fmt.Errorf("unknown action %s, use pause, remove or reannounce", parts[0])
+	}
+
+	var err error
+	if hours, herr := strconv.ParseFloat(parts[1], 64); herr == nil {
+		rule.Time = time.Duration(hours * float64(time.Hour))
+	} else if rule.Time, err = time.ParseDuration(parts[1]); err != nil {
+		return nil, fmt.Errorf("%s is not a duration or a number of hours", parts[1])
+	}
+	if rule.Time <= 0 {
+		return nil, fmt.Errorf("%s must be more than zero", parts[1])
+	}
+
+	return rule, nil
+}
+
+// String formats the rule the same way parseStallRule takes it
+func (r *StallRule) String() string {
+	return fmt.Sprintf("%s:%s", r.Action, r.Time)
+}
+
+// stallReasons returns why a torrent that's been stuck for as long as stuck counts as stalled,
+// nothing if it doesn't.
+func stallReasons(torrent *deluge.Torrent, stuck time.Duration) []string {
+	if torrent.State != "Downloading" {
+		return nil
+	}
+
+	var reasons []string
+	if stuck >= StallTime {
+		reasons = append(reasons, "no progress")
+	}
+	if stuck >= stallGrace {
+		if torrent.TotalSeeds == 0 && torrent.DistributedCopies < 1 {
+			reasons = append(reasons, "no seeds")
+		}
+		if torrent.DownloadPayloadRate == 0 {
+			reasons = append(reasons, "no download rate")
+		}
+	}
+	return reasons
+}
+
+// stalledFile returns the file the stuck torrents persist to, or "" if there's no -datadir,
+// so torrents that have been stuck for weeks don't start over with every restart.
+func stalledFile() string {
+	if DataDir == "" {
+		return ""
+	}
+	return filepath.Join(DataDir, "stalled.json")
+}
+
+// loadStalled reads the persisted stuck torrents, if there are any
+func loadStalled() {
+	file := stalledFile()
+	if file == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Stalled: %s", err)
+		}
+		return
+	}
+
+	saved := make(map[string]map[string]*stuckTorrent)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("[ERROR] Stalled: %s", err)
+		return
+	}
+
+	stallTrackersMu.Lock()
+	defer stallTrackersMu.Unlock()
+	for _, v := range views {
+		if stuck, ok := saved[v.Name]; ok {
+			stallTrackers[v.Name].stuck = stuck
+		}
+	}
+}
+
+// saveStalled persists the stuck torrents, stallTrackersMu must be held
+func saveStalled() {
+	file := stalledFile()
+	if file == "" {
+		return
+	}
+
+	saved := make(map[string]map[string]*stuckTorrent)
+	for name, t := range stallTrackers {
+		saved[name] = t.stuck
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Printf("[ERROR] Stalled: %s", err)
+		return
+	}
+
+	// write then rename, so a crash never leaves half a file behind
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		log.Printf("[ERROR] Stalled: %s", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Printf("[ERROR] Stalled: %s", err)
+	}
+}
+
+// trackStalled keeps up with the progress of every backend's downloading torrents every
+// stallInterval, alerts about the ones that stall and applies the stall rules to them,
+// it runs in its own go-routine.
+func trackStalled() {
+	stallTrackersMu.Lock()
+	for _, v := range views {
+		stallTrackers[v.Name] = &stallTracker{
+			delta: v.Client.NewDelta(stallFields...),
+			stuck: make(map[string]*stuckTorrent),
+		}
+	}
+	stallTrackersMu.Unlock()
+	loadStalled()
+
+	for {
+		for _, v := range views {
+			if err := checkStalled(v, time.Now()); err != nil {
+				log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			}
+		}
+
+		stallTrackersMu.Lock()
+		saveStalled()
+		stallTrackersMu.Unlock()
+
+		if !sleep(stallInterval) {
+			return
+		}
+	}
+}
+
+// checkStalled updates since when the view's downloading torrents are stuck, a torrent
+// that isn't downloading or made progress starts over.
+func checkStalled(v *View, now time.Time) error {
+	stallTrackersMu.Lock()
+	t := stallTrackers[v.Name]
+	stallTrackersMu.Unlock()
+
+	if _, _, err := t.delta.Update(); err != nil {
+		return err
+	}
+	torrents := t.delta.Torrents()
+
+	var stalls []*stall
+	downloading := make(map[string]bool)
+
+	stallTrackersMu.Lock()
+	t.torrents = torrents
+	for _, torrent := range torrents {
+		if torrent.State != "Downloading" {
+			continue
+		}
+		downloading[torrent.Hash] = true
+
+		s, ok := t.stuck[torrent.Hash]
+		if !ok || s.Done != torrent.TotalDone {
+			t.stuck[torrent.Hash] = &stuckTorrent{Done: torrent.TotalDone, Since: now}
+			continue
+		}
+
+		stuck := now.Sub(s.Since)
+		reasons := stallReasons(torrent, stuck)
+		if len(reasons) == 0 {
+			continue
+		}
+
+		st := &stall{torrent: torrent, stuck: stuck, reasons: reasons, rules: dueStallRules(s, stuck)}
+		if StallAlerts && !s.Alerted {
+			s.Alerted, st.alert = true, true
+		}
+		if st.alert || len(st.rules) > 0 {
+			stalls = append(stalls, st)
+		}
+	}
+
+	// forget the torrents that finished, stopped or got removed
+	for hash := range t.stuck {
+		if !downloading[hash] {
+			delete(t.stuck, hash)
+		}
+	}
+	stallTrackersMu.Unlock()
+
+	// the alerts and the rules go without the lock, they call Telegram and Deluge
+	for _, st := range stalls {
+		if st.alert {
+			notify(fmt.Sprintf("%sStalled: %s (%.1f%%) for %s: %s", v.Label(), st.torrent.Name,
+				st.torrent.Progress, st.stuck.Truncate(time.Minute), strings.Join(st.reasons, ", ")), false)
+		}
+		applyStallRules(v, st.torrent, st.rules, st.stuck)
+	}
+
+	return nil
+}
+
+// dueStallRules returns the rules whose time has come for a stalled torrent and marks them as applied,
+// each rule applies once; stallTrackersMu must be held.
+func dueStallRules(s *stuckTorrent, stuck time.Duration) []*StallRule {
+	var rules []*StallRule
+	for _, rule := range stallRules {
+		if stuck < rule.Time || s.Applied[rule.String()] {
+			continue
+		}
+		if s.Applied == nil {
+			s.Applied = make(map[string]bool)
+		}
+		s.Applied[rule.String()] = true
+		rules = append(rules, rule)
+
+		// there's nothing left to do about a torrent that's no longer downloading
+		if rule.Action != "reannounce" {
+			break
+		}
+	}
+	return rules
+}
+
+// applyStallRules applies the due rules to a stalled torrent
+func applyStallRules(v *View, torrent *deluge.Torrent, rules []*StallRule, stuck time.Duration) {
+	for _, rule := range rules {
+		var (
+			err  error
+			done string
+		)
+		switch rule.Action {
+		case "pause":
+			err, done = v.Client.PauseTorrent(torrent.Hash), "Paused"
+		case "remove":
+			err, done = v.Client.RemoveTorrent(torrent.Hash, false), "Removed"
+		case "reannounce":
+			err, done = v.Client.ForceReannounce(torrent.Hash), "Reannounced"
+		}
+		if err != nil {
+			log.Printf("[ERROR] Deluge: %s", err)
+			notify(fmt.Sprintf("%sstalled: failed to %s %s: %s", v.Label(), rule.Action, torrent.Name, err), false)
+			continue
+		}
+
+		log.Printf("[INFO] Stall policy: %s %s on %s after being stuck for %s", rule.Action, torrent.Name, v.Name, stuck)
+		notify(fmt.Sprintf("%sstalled: %s %s after being stuck for %s (rule: %s)",
+			v.Label(), done, torrent.Name, stuck.Truncate(time.Minute), rule), false)
+	}
+}
+
+// stalled lists the downloading torrents that are stalled, with how long each has been stuck
+func stalled(view *View, ud tgbotapi.Update) {
+	stallTrackersMu.Lock()
+	t, ok := stallTrackers[view.Name]
+	if !ok {
+		stallTrackersMu.Unlock()
+		send("stalled: not tracking torrents yet, try again in a minute", ud.Message.Chat.ID, false)
+		return
+	}
+
+	now := time.Now()
+	buf := new(bytes.Buffer)
+	hashes := make(map[string]string) // the line of each stalled torrent, to find their IDs
+	for _, torrent := range t.torrents {
+		s, ok := t.stuck[torrent.Hash]
+		if !ok {
+			continue
+		}
+		stuck := now.Sub(s.Since)
+		if reasons := stallReasons(torrent, stuck); len(reasons) > 0 {
+			hashes[torrent.Hash] = fmt.Sprintf("%s (*%.1f%%*)\nstuck for *%s*: %s\n\n", mdReplacer.Replace(torrent.Name),
+				torrent.Progress, stuck.Truncate(time.Minute), strings.Join(reasons, ", "))
+		}
+	}
+	stallTrackersMu.Unlock()
+
+	if len(hashes) == 0 {
+		send("No stalled torrents", ud.Message.Chat.ID, false)
+		return
+	}
+
+	// list them with the IDs the other commands take
+	if err := view.Update(stateFields...); err != nil {
+		send("stalled: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+	for _, torrent := range view.Torrents {
+		if line, ok := hashes[torrent.Hash]; ok {
+			buf.WriteString(fmt.Sprintf("`<%d>` %s", torrent.ID, line))
+		}
+	}
+
+	send(buf.String(), ud.Message.Chat.ID, true)
+}
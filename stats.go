@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Transfer is an amount of uploaded and downloaded bytes
+type Transfer struct {
+	Upload   float64 `json:"upload"`
+	Download float64 `json:"download"`
+}
+
+// transferCounters are the bot's own daily and monthly transfer totals of a backend,
+// Deluge's totals start over whenever the daemon restarts.
+type transferCounters struct {
+	Days   map[string]*Transfer `json:"days"`   // by "2006-01-02"
+	Months map[string]*Transfer `json:"months"` // by "2006-01"
+
+	// the session totals of the last sample, to tell how much was transferred since then
+	last *Transfer
+}
+
+var (
+	// transfer counters by backend name
+	transfers   = make(map[string]*transferCounters)
+	transfersMu sync.Mutex
+
+	// how often the session totals get sampled into the transfer counters
+	transferInterval = time.Minute
+
+	// when the bot started, for its uptime
+	startTime = time.Now()
+)
+
+// transfersFile returns the file the transfer counters persist to, or "" if there's no -datadir
+func transfersFile() string {
+	if DataDir == "" {
+		return ""
+	}
+	return filepath.Join(DataDir, "transfers.json")
+}
+
+// loadTransfers reads the persisted transfer counters, if there are any
+func loadTransfers() {
+	file := transfersFile()
+	if file == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Transfers: %s", err)
+		}
+		return
+	}
+
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	if err := json.Unmarshal(data, &transfers); err != nil {
+		log.Printf("[ERROR] Transfers: %s", err)
+	}
+}
+
+// saveTransfers persists the transfer counters, transfersMu must be held
+func saveTransfers() {
+	file := transfersFile()
+	if file == "" {
+		return
+	}
+
+	data, err := json.Marshal(transfers)
+	if err != nil {
+		log.Printf("[ERROR] Transfers: %s", err)
+		return
+	}
+
+	// write then rename, so a crash never leaves half a file behind
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		log.Printf("[ERROR] Transfers: %s", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Printf("[ERROR] Transfers: %s", err)
+	}
+}
+
+// trackTransfers samples the session totals of every backend into the transfer counters
+// every transferInterval, and once more when the bot is stopping; it runs in its own go-routine.
+func trackTransfers() {
+	loadTransfers()
+
+	sampleTransfers()
+	for sleep(transferInterval) {
+		sampleTransfers()
+	}
+
+	// what got transferred since the last sample would be lost otherwise
+	sampleTransfers()
+}
+
+// sampleTransfers counts the session totals of every backend and saves the transfer counters
+func sampleTransfers() {
+	for _, v := range views {
+		status, err := v.Client.SessionStatus()
+		if err != nil {
+			log.Printf("[ERROR] Deluge %s: %s", v.Name, err)
+			continue
+		}
+		countTransfer(v.Name, &Transfer{status.TotalUpload, status.TotalDownload}, time.Now())
+	}
+
+	transfersMu.Lock()
+	saveTransfers()
+	transfersMu.Unlock()
+}
+
+// countTransfer adds what was transferred since the last sample to the day and month of now,
+// totals lower than the last sample mean that the daemon restarted and started over from zero.
+func countTransfer(name string, totals *Transfer, now time.Time) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+
+	c, ok := transfers[name]
+	if !ok {
+		c = &transferCounters{}
+		transfers[name] = c
+	}
+	if c.Days == nil {
+		c.Days = make(map[string]*Transfer)
+	}
+	if c.Months == nil {
+		c.Months = make(map[string]*Transfer)
+	}
+
+	// the first sample since the bot started only sets where to count from
+	if c.last == nil {
+		c.last = totals
+		return
+	}
+
+	delta := &Transfer{totals.Upload - c.last.Upload, totals.Download - c.last.Download}
+	if delta.Upload < 0 || delta.Download < 0 {
+		delta = totals
+	}
+	c.last = totals
+
+	for key, counters := range map[string]map[string]*Transfer{
+		now.Format("2006-01-02"): c.Days,
+		now.Format("2006-01"):    c.Months,
+	} {
+		t, ok := counters[key]
+		if !ok {
+			t = &Transfer{}
+			counters[key] = t
+		}
+		t.Upload += delta.Upload
+		t.Download += delta.Download
+	}
+
+	// keep two months of days and two years of months
+	for day := range c.Days {
+		if d, err := time.ParseInLocation("2006-01-02", day, now.Location()); err == nil && now.Sub(d) > 62*24*time.Hour {
+			delete(c.Days, day)
+		}
+	}
+	for month := range c.Months {
+		if m, err := time.ParseInLocation("2006-01", month, now.Location()); err == nil && now.Sub(m) > 2*365*24*time.Hour {
+			delete(c.Months, month)
+		}
+	}
+}
+
+// transferOf returns what the backend transferred in the day or month of key
+func transferOf(name, key string) Transfer {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+
+	c, ok := transfers[name]
+	if !ok {
+		return Transfer{}
+	}
+	if t, ok := c.Days[key]; ok {
+		return *t
+	}
+	if t, ok := c.Months[key]; ok {
+		return *t
+	}
+	return Transfer{}
+}
+
+// stats sends the session's statistics along with the bot's own daily and monthly transfer totals
+func stats(view *View, ud tgbotapi.Update) {
+	status, err := view.Client.SessionStatus()
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+		send("stats: "+err.Error(), ud.Message.Chat.ID, false)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("*Session*\n")
+	buf.WriteString(fmt.Sprintf("Downloaded: *%s*  Uploaded: *%s*\n",
+		humanize.Bytes(uint64(status.TotalDownload)), humanize.Bytes(uint64(status.TotalUpload))))
+	buf.WriteString(fmt.Sprintf("Overhead: ↓ *%s*  ↑ *%s* (*%s/s*  *%s/s*)\n",
+		humanize.Bytes(uint64(status.TotalDownload-status.TotalPayloadDownload)),
+		humanize.Bytes(uint64(status.TotalUpload-status.TotalPayloadUpload)),
+		humanize.Bytes(uint64(status.DownloadRate-status.PayloadDownloadRate)),
+		humanize.Bytes(uint64(status.UploadRate-status.PayloadUploadRate))))
+	buf.WriteString(fmt.Sprintf("Peers: *%d*  DHT nodes: *%d*\n", status.NumPeers, status.DHTNodes))
+
+	if free, err := view.Client.FreeSpace(""); err == nil {
+		buf.WriteString(fmt.Sprintf("Free space: *%s*\n", humanize.Bytes(uint64(free))))
+	} else {
+		log.Printf("[ERROR] Deluge: %s", err)
+	}
+
+	// incoming connections
+	port, err := view.Client.ListenPort()
+	if err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+	}
+	incoming := "no"
+	if status.HasIncomingConnections {
+		incoming = "yes"
+	}
+	test := "untested"
+	if open, err := view.Client.TestListenPort(); err != nil {
+		log.Printf("[ERROR] Deluge: %s", err)
+	} else if open {
+		test = "open"
+	} else {
+		test = "closed"
+	}
+	buf.WriteString(fmt.Sprintf("Incoming connections: *%s*, port *%d* is *%s*\n", incoming, port, test))
+
+	now := time.Now()
+	today, month := transferOf(view.Name, now.Format("2006-01-02")), transferOf(view.Name, now.Format("2006-01"))
+	buf.WriteString(fmt.Sprintf("\n*Today*\n↓ *%s*  ↑ *%s*\n", humanize.Bytes(uint64(today.Download)), humanize.Bytes(uint64(today.Upload))))
+	buf.WriteString(fmt.Sprintf("*This month*\n↓ *%s*  ↑ *%s*\n", humanize.Bytes(uint64(month.Download)), humanize.Bytes(uint64(month.Upload))))
+
+	buf.WriteString(fmt.Sprintf("\nBot uptime: *%s*", time.Since(startTime).Truncate(time.Second)))
+
+	send(buf.String(), ud.Message.Chat.ID, true)
+}